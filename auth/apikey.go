@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"strings"
+	"time"
+)
+
+const apiKeyTag = "gak"
+const apiKeyPrefixSize = 6
+const apiKeySecretSize = 32
+const apiKeyLastUsedResolution = time.Minute
+
+var ErrInvalidApiKey = errors.New("invalid api key")
+var ErrInvalidApiKeyScope = errors.New("api key scopes must be a subset of your roles")
+var ErrInvalidApiKeyTTL = errors.New("api key lifetime exceeds the allowed maximum")
+
+type ApiKeyConfig struct {
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+func DefaultApiKeyConfig() *ApiKeyConfig {
+	return &ApiKeyConfig{
+		DefaultTTL: time.Hour * 24 * 90,
+		MaxTTL:     time.Hour * 24 * 365,
+	}
+}
+
+type CreatedApiKey struct {
+	*persist.ApiKey
+	Key string `json:"key"`
+}
+
+type ApiKeyService interface {
+	Create(user *persist.User, name string, scopes []string, ttl time.Duration) (*CreatedApiKey, error)
+	FindAll(username string) ([]*persist.ApiKey, error)
+	Revoke(username string, id uint) (bool, error)
+	RevokeAll(username string) error
+	Authenticate(key string) (*persist.User, *persist.ApiKey, error)
+}
+
+type DefaultApiKeyService struct {
+	userRepo   persist.UserRepository
+	apiKeyRepo persist.ApiKeyRepository
+	config     *ApiKeyConfig
+}
+
+func (s *DefaultApiKeyService) Create(user *persist.User, name string, scopes []string,
+	ttl time.Duration) (*CreatedApiKey, error) {
+	for _, scope := range scopes {
+		if !ContainsRole(user.Roles, scope) {
+			return nil, ErrInvalidApiKeyScope
+		}
+	}
+	if ttl == 0 {
+		ttl = s.config.DefaultTTL
+	}
+	if ttl < 0 || ttl > s.config.MaxTTL {
+		return nil, ErrInvalidApiKeyTTL
+	}
+	prefix, err := util.GenerateRandomToken(apiKeyPrefixSize)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := util.GenerateRandomToken(apiKeySecretSize)
+	if err != nil {
+		return nil, err
+	}
+	key := apiKeyTag + "_" + prefix + "_" + secret
+	stored := &persist.ApiKey{
+		OwnerRefer: user.Username,
+		Name:       name,
+		Prefix:     prefix,
+		KeyHash:    util.HashToken(key),
+		Scopes:     strings.Join(scopes, ","),
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	err = s.apiKeyRepo.Save(stored)
+	if err != nil {
+		return nil, err
+	}
+	return &CreatedApiKey{ApiKey: stored, Key: key}, nil
+}
+
+func (s *DefaultApiKeyService) FindAll(username string) ([]*persist.ApiKey, error) {
+	return s.apiKeyRepo.FindAllByOwnerUsername(username)
+}
+
+func (s *DefaultApiKeyService) Revoke(username string, id uint) (bool, error) {
+	return s.apiKeyRepo.Revoke(username, id)
+}
+
+func (s *DefaultApiKeyService) RevokeAll(username string) error {
+	return s.apiKeyRepo.RevokeAllByOwnerUsername(username)
+}
+
+func (s *DefaultApiKeyService) Authenticate(key string) (*persist.User, *persist.ApiKey, error) {
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return nil, nil, ErrInvalidApiKey
+	}
+	stored, err := s.apiKeyRepo.FindByPrefix(prefix)
+	if err != nil {
+		return nil, nil, ErrInvalidApiKey
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.KeyHash), []byte(util.HashToken(key))) != 1 ||
+		stored.Revoked || time.Now().After(stored.ExpiresAt) {
+		return nil, nil, ErrInvalidApiKey
+	}
+	user, err := s.userRepo.FindByUsername(stored.OwnerRefer)
+	if err != nil {
+		return nil, nil, ErrInvalidApiKey
+	}
+	now := time.Now()
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) > apiKeyLastUsedResolution {
+		err = s.apiKeyRepo.UpdateLastUsed(stored.ID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		stored.LastUsedAt = &now
+	}
+	scoped := *user
+	scoped.Roles = nil
+	scopes := strings.Split(stored.Scopes, ",")
+	for _, role := range user.Roles {
+		if containsString(scopes, role.Name) {
+			scoped.Roles = append(scoped.Roles, role)
+		}
+	}
+	return &scoped, stored, nil
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	start := len(apiKeyTag) + 1
+	end := start + base64.RawURLEncoding.EncodedLen(apiKeyPrefixSize)
+	if !strings.HasPrefix(key, apiKeyTag+"_") || len(key) <= end || key[end] != '_' {
+		return "", false
+	}
+	return key[start:end], true
+}
+
+func NewDefaultApiKeyService(userRepo persist.UserRepository, apiKeyRepo persist.ApiKeyRepository,
+	config *ApiKeyConfig) ApiKeyService {
+	return &DefaultApiKeyService{
+		userRepo:   userRepo,
+		apiKeyRepo: apiKeyRepo,
+		config:     config,
+	}
+}
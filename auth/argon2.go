@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2idMemory      = 19 * 1024
+	argon2idIterations  = 2
+	argon2idParallelism = 1
+	argon2idSaltLength  = 16
+	argon2idKeyLength   = 32
+)
+
+type Argon2idPasswordEncoder struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func (e *Argon2idPasswordEncoder) Encode(password string) (string, error) {
+	salt, err := generateSalt(argon2idSaltLength)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, e.iterations, e.memory, e.parallelism, argon2idKeyLength)
+	params := fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, e.memory, e.iterations, e.parallelism)
+	return encodePhcHash(EncoderArgon2id, params, salt, key), nil
+}
+
+func (e *Argon2idPasswordEncoder) Compare(hash, raw string) bool {
+	version, memory, iterations, parallelism, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil || version != argon2.Version {
+		return false
+	}
+	other := argon2.IDKey([]byte(raw), salt, iterations, memory, parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (e *Argon2idPasswordEncoder) NeedsRehash(hash string) bool {
+	version, memory, iterations, parallelism, _, _, err := decodeArgon2idHash(hash)
+	return err != nil || version != argon2.Version ||
+		memory < e.memory || iterations < e.iterations || parallelism < e.parallelism
+}
+
+func NewArgon2idPasswordEncoder() *Argon2idPasswordEncoder {
+	return &Argon2idPasswordEncoder{
+		memory:      argon2idMemory,
+		iterations:  argon2idIterations,
+		parallelism: argon2idParallelism,
+	}
+}
+
+func decodeArgon2idHash(hash string) (version int, memory, iterations uint32, parallelism uint8,
+	salt, key []byte, err error) {
+	if encoderId(hash) != EncoderArgon2id {
+		return 0, 0, 0, 0, nil, nil, errInvalidHash
+	}
+	params, salt, key, err := decodePhcHash(hash)
+	if err != nil || len(params) != 2 {
+		return 0, 0, 0, 0, nil, nil, errInvalidHash
+	}
+	_, err = fmt.Sscanf(params[0], "v=%d", &version)
+	if err != nil {
+		return 0, 0, 0, 0, nil, nil, errInvalidHash
+	}
+	_, err = fmt.Sscanf(params[1], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism)
+	if err != nil || len(key) == 0 {
+		return 0, 0, 0, 0, nil, nil, errInvalidHash
+	}
+	return version, memory, iterations, parallelism, salt, key, nil
+}
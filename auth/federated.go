@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"strings"
+	"sync"
+	"time"
+)
+
+const federatedStateSize = 32
+const federatedNonceSize = 16
+const federatedRequestTimeout = time.Second * 10
+
+var ErrUnknownFederatedProvider = errors.New("unknown identity provider")
+var ErrInvalidFederatedState = errors.New("invalid or expired federated login state")
+var ErrFederatedLoginFailed = errors.New("federated login failed")
+var ErrFederatedIdentityNotLinked = errors.New("identity is not linked to an account")
+var ErrFederatedIdentityLinked = errors.New("identity is already linked to another account")
+var ErrFederatedUsernameTaken = errors.New("username is taken, sign in and link the identity instead")
+var ErrExternallyManagedAccount = errors.New("the password of this account is managed by an external identity provider")
+
+type FederatedProviderConfig struct {
+	Name              string
+	Issuer            string
+	ClientId          string
+	ClientSecret      string
+	RedirectUrl       string
+	Scopes            []string
+	UsernameClaim     string
+	GroupsClaim       string
+	GroupRoles        GroupRoleMapping
+	AutoProvision     bool
+	LinkVerifiedEmail bool
+}
+
+func DefaultFederatedProviderConfig(name string) *FederatedProviderConfig {
+	return &FederatedProviderConfig{
+		Name:          name,
+		Scopes:        []string{oidc.ScopeOpenID, "profile", "email"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AutoProvision: true,
+	}
+}
+
+type FederatedConfig struct {
+	Providers  []*FederatedProviderConfig
+	SessionTTL time.Duration
+}
+
+func DefaultFederatedConfig() *FederatedConfig {
+	return &FederatedConfig{
+		SessionTTL: time.Minute * 10,
+	}
+}
+
+type FederatedLogin struct {
+	AuthorizationUrl string `json:"authorization_url"`
+	State            string `json:"-"`
+	ExpiresIn        int64  `json:"expires_in"`
+}
+
+type FederatedService interface {
+	Providers() []string
+	Begin(provider, linkUsername string) (*FederatedLogin, error)
+	Complete(provider, state, code string) (*persist.User, error)
+	Identities(username string) ([]*persist.FederatedIdentity, error)
+	Unlink(username string, id uint) (bool, error)
+	ExternallyManaged(username string) (bool, error)
+}
+
+type DefaultFederatedService struct {
+	userRepo     persist.UserRepository
+	identityRepo persist.FederatedIdentityRepository
+	sessionRepo  persist.FederatedLoginSessionRepository
+	encoder      PasswordEncoder
+	tokenService TokenService
+	config       *FederatedConfig
+	discovered   map[string]*oidc.Provider
+	mu           sync.Mutex
+}
+
+func (s *DefaultFederatedService) Providers() []string {
+	names := make([]string, len(s.config.Providers))
+	for i, provider := range s.config.Providers {
+		names[i] = provider.Name
+	}
+	return names
+}
+
+func (s *DefaultFederatedService) Begin(provider, linkUsername string) (*FederatedLogin, error) {
+	config, ok := s.providerConfig(provider)
+	if !ok {
+		return nil, ErrUnknownFederatedProvider
+	}
+	oauth2Config, _, err := s.oauth2Config(config)
+	if err != nil {
+		return nil, err
+	}
+	state, err := util.GenerateRandomToken(federatedStateSize)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := util.GenerateRandomToken(federatedNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	err = s.sessionRepo.Save(&persist.FederatedLoginSession{
+		StateHash:      util.HashToken(state),
+		Provider:       config.Name,
+		Nonce:          nonce,
+		CodeVerifier:   verifier,
+		ExpiresAt:      time.Now().Add(s.config.SessionTTL),
+		LinkOwnerRefer: linkUsername,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FederatedLogin{
+		AuthorizationUrl: oauth2Config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)),
+		State:            state,
+		ExpiresIn:        int64(s.config.SessionTTL.Seconds()),
+	}, nil
+}
+
+func (s *DefaultFederatedService) Complete(provider, state, code string) (*persist.User, error) {
+	config, ok := s.providerConfig(provider)
+	if !ok {
+		return nil, ErrUnknownFederatedProvider
+	}
+	session, err := s.sessionRepo.FindByHash(util.HashToken(state))
+	if err != nil || session.Used || time.Now().After(session.ExpiresAt) || session.Provider != config.Name {
+		return nil, ErrInvalidFederatedState
+	}
+	marked, err := s.sessionRepo.MarkUsed(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ErrInvalidFederatedState
+	}
+	subject, claims, err := s.exchange(config, session, code)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := s.identityRepo.Find(config.Name, subject)
+	if err != nil {
+		return nil, err
+	}
+	var user *persist.User
+	switch {
+	case session.LinkOwnerRefer != "":
+		user, err = s.link(config, identity, session.LinkOwnerRefer, subject, claims)
+	case identity.ID != 0:
+		user, err = s.userRepo.FindByUsername(identity.OwnerRefer)
+	default:
+		user, err = s.provision(config, subject, claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syncGroupRoles(s.userRepo, s.tokenService, config.GroupRoles, user,
+		stringClaims(claims[config.GroupsClaim]))
+}
+
+func (s *DefaultFederatedService) Identities(username string) ([]*persist.FederatedIdentity, error) {
+	return s.identityRepo.FindAllByOwnerUsername(username)
+}
+
+func (s *DefaultFederatedService) Unlink(username string, id uint) (bool, error) {
+	return s.identityRepo.Delete(username, id)
+}
+
+func (s *DefaultFederatedService) ExternallyManaged(username string) (bool, error) {
+	identities, err := s.identityRepo.FindAllByOwnerUsername(username)
+	if err != nil {
+		return false, err
+	}
+	for _, identity := range identities {
+		if identity.Provisioned || identity.Provider == LdapProvider {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *DefaultFederatedService) exchange(config *FederatedProviderConfig, session *persist.FederatedLoginSession,
+	code string) (string, map[string]interface{}, error) {
+	oauth2Config, provider, err := s.oauth2Config(config)
+	if err != nil {
+		return "", nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), federatedRequestTimeout)
+	defer cancel()
+	token, err := oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(session.CodeVerifier))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrFederatedLoginFailed, err)
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: no id_token in token response", ErrFederatedLoginFailed)
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.ClientId}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrFederatedLoginFailed, err)
+	}
+	if idToken.Nonce != session.Nonce {
+		return "", nil, fmt.Errorf("%w: nonce mismatch", ErrFederatedLoginFailed)
+	}
+	claims := make(map[string]interface{})
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrFederatedLoginFailed, err)
+	}
+	return idToken.Subject, claims, nil
+}
+
+func (s *DefaultFederatedService) link(config *FederatedProviderConfig, identity *persist.FederatedIdentity,
+	username, subject string, claims map[string]interface{}) (*persist.User, error) {
+	if identity.ID != 0 && identity.OwnerRefer != username {
+		return nil, ErrFederatedIdentityLinked
+	}
+	user, err := s.userRepo.FindByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if identity.ID != 0 {
+		return user, nil
+	}
+	return user, s.saveIdentity(config, user, subject, claims, false)
+}
+
+func (s *DefaultFederatedService) provision(config *FederatedProviderConfig, subject string,
+	claims map[string]interface{}) (*persist.User, error) {
+	email, verified := verifiedEmail(claims)
+	if config.LinkVerifiedEmail && verified {
+		existing, err := s.userRepo.FindByEmail(email)
+		if err == nil && existing.EmailVerified {
+			return existing, s.saveIdentity(config, existing, subject, claims, false)
+		}
+	}
+	if !config.AutoProvision {
+		return nil, ErrFederatedIdentityNotLinked
+	}
+	username, _ := claims[config.UsernameClaim].(string)
+	if username == "" {
+		username = subject
+	}
+	if _, err := s.userRepo.FindByUsername(username); err == nil {
+		return nil, ErrFederatedUsernameTaken
+	}
+	password, err := newRandomPasswordHash(s.encoder)
+	if err != nil {
+		return nil, err
+	}
+	user := &persist.User{Username: username, Password: password}
+	if verified {
+		if _, err := s.userRepo.FindByEmail(email); err != nil {
+			user.Email = email
+			user.EmailVerified = true
+		}
+	}
+	err = s.userRepo.Save(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, s.saveIdentity(config, user, subject, claims, true)
+}
+
+func (s *DefaultFederatedService) saveIdentity(config *FederatedProviderConfig, user *persist.User, subject string,
+	claims map[string]interface{}, provisioned bool) error {
+	email, _ := claims["email"].(string)
+	return s.identityRepo.Save(&persist.FederatedIdentity{
+		Provider:    config.Name,
+		Subject:     subject,
+		Email:       email,
+		Provisioned: provisioned,
+		OwnerRefer:  user.Username,
+	})
+}
+
+func (s *DefaultFederatedService) oauth2Config(config *FederatedProviderConfig) (*oauth2.Config, *oidc.Provider, error) {
+	provider, err := s.discover(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     config.ClientId,
+		ClientSecret: config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  config.RedirectUrl,
+		Scopes:       config.Scopes,
+	}, provider, nil
+}
+
+func (s *DefaultFederatedService) discover(config *FederatedProviderConfig) (*oidc.Provider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if provider, ok := s.discovered[config.Name]; ok {
+		return provider, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), federatedRequestTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	s.discovered[config.Name] = provider
+	return provider, nil
+}
+
+func (s *DefaultFederatedService) providerConfig(name string) (*FederatedProviderConfig, bool) {
+	for _, provider := range s.config.Providers {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+func verifiedEmail(claims map[string]interface{}) (string, bool) {
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	return strings.ToLower(email), verified && email != ""
+}
+
+func stringClaims(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func NewDefaultFederatedService(userRepo persist.UserRepository, identityRepo persist.FederatedIdentityRepository,
+	sessionRepo persist.FederatedLoginSessionRepository, encoder PasswordEncoder, tokenService TokenService,
+	config *FederatedConfig) FederatedService {
+	return &DefaultFederatedService{
+		userRepo:     userRepo,
+		identityRepo: identityRepo,
+		sessionRepo:  sessionRepo,
+		encoder:      encoder,
+		tokenService: tokenService,
+		config:       config,
+		discovered:   make(map[string]*oidc.Provider),
+	}
+}
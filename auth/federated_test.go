@@ -0,0 +1,409 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"gin-auth/persist"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const stubIdpKeyId = "stub-key"
+const stubIdpClientId = "gin-auth"
+const stubIdpClientSecret = "stub-secret"
+const stubIdpProvider = "stub"
+
+type stubIdpGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+type stubIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]*stubIdpGrant
+}
+
+func newStubIdp(t *testing.T) *stubIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdp{key: key, grants: map[string]*stubIdpGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *stubIdp) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := idp.server.URL
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *stubIdp) jwks(w http.ResponseWriter, r *http.Request) {
+	public := idp.key.PublicKey
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": stubIdpKeyId,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *stubIdp) token(w http.ResponseWriter, r *http.Request) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok || clientId != stubIdpClientId || clientSecret != stubIdpClientSecret {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostFormValue("code")]
+	delete(idp.grants, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !ok {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	digest := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(digest[:]) != grant.challenge {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = stubIdpKeyId
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": "stub-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (idp *stubIdp) authorize(t *testing.T, authorizationUrl string, claims jwt.MapClaims) string {
+	parsed, err := url.Parse(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization url lacks a S256 PKCE challenge: %s", authorizationUrl)
+	}
+	if query.Get("nonce") == "" || query.Get("state") == "" {
+		t.Fatalf("authorization url lacks state or nonce: %s", authorizationUrl)
+	}
+	now := time.Now()
+	idClaims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   stubIdpClientId,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+	code := "code-" + query.Get("state")
+	idp.mu.Lock()
+	idp.grants[code] = &stubIdpGrant{challenge: query.Get("code_challenge"), claims: idClaims}
+	idp.mu.Unlock()
+	return code
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+type memoryFederatedIdentityRepository struct {
+	mu         sync.Mutex
+	identities []*persist.FederatedIdentity
+}
+
+func (r *memoryFederatedIdentityRepository) Save(identity *persist.FederatedIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	identity.ID = uint(len(r.identities) + 1)
+	r.identities = append(r.identities, identity)
+	return nil
+}
+
+func (r *memoryFederatedIdentityRepository) Find(provider, subject string) (*persist.FederatedIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, identity := range r.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return &persist.FederatedIdentity{}, nil
+}
+
+func (r *memoryFederatedIdentityRepository) FindAllByOwnerUsername(ownerUsername string) ([]*persist.FederatedIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var identities []*persist.FederatedIdentity
+	for _, identity := range r.identities {
+		if identity.OwnerRefer == ownerUsername {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (r *memoryFederatedIdentityRepository) Delete(ownerUsername string, id uint) (bool, error) {
+	return false, nil
+}
+
+type memoryFederatedLoginSessionRepository struct {
+	mu       sync.Mutex
+	sessions map[string]*persist.FederatedLoginSession
+}
+
+func (r *memoryFederatedLoginSessionRepository) Save(session *persist.FederatedLoginSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session.ID = uint(len(r.sessions) + 1)
+	r.sessions[session.StateHash] = session
+	return nil
+}
+
+func (r *memoryFederatedLoginSessionRepository) FindByHash(hash string) (*persist.FederatedLoginSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, ok := r.sessions[hash]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (r *memoryFederatedLoginSessionRepository) MarkUsed(id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, session := range r.sessions {
+		if session.ID == id && !session.Used {
+			session.Used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type revocationRecorder struct {
+	TokenService
+	revoked []string
+}
+
+func (r *revocationRecorder) RevokeAll(username string) error {
+	r.revoked = append(r.revoked, username)
+	return nil
+}
+
+type federatedFixture struct {
+	idp        *stubIdp
+	users      *memoryUserRepository
+	identities *memoryFederatedIdentityRepository
+	tokens     *revocationRecorder
+	provider   *FederatedProviderConfig
+	service    FederatedService
+}
+
+func newFederatedFixture(t *testing.T, users ...*persist.User) *federatedFixture {
+	idp := newStubIdp(t)
+	provider := DefaultFederatedProviderConfig(stubIdpProvider)
+	provider.Issuer = idp.server.URL
+	provider.ClientId = stubIdpClientId
+	provider.ClientSecret = stubIdpClientSecret
+	provider.RedirectUrl = "http://localhost/federated/stub/callback"
+	provider.GroupRoles = GroupRoleMapping{"moderators": RoleModerator, "staff": RoleManager}
+	config := DefaultFederatedConfig()
+	config.Providers = []*FederatedProviderConfig{provider}
+	fixture := &federatedFixture{
+		idp:        idp,
+		users:      newMemoryUserRepository(users...),
+		identities: &memoryFederatedIdentityRepository{},
+		tokens:     &revocationRecorder{},
+		provider:   provider,
+	}
+	fixture.service = NewDefaultFederatedService(fixture.users, fixture.identities,
+		&memoryFederatedLoginSessionRepository{sessions: map[string]*persist.FederatedLoginSession{}},
+		&slowPasswordEncoder{version: "v1"}, fixture.tokens, config)
+	return fixture
+}
+
+func (f *federatedFixture) login(t *testing.T, claims jwt.MapClaims) (*persist.User, error) {
+	login, err := f.service.Begin(stubIdpProvider, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := f.idp.authorize(t, login.AuthorizationUrl, claims)
+	return f.service.Complete(stubIdpProvider, login.State, code)
+}
+
+func TestFederatedLoginProvisionsUser(t *testing.T) {
+	fixture := newFederatedFixture(t)
+
+	user, err := fixture.login(t, jwt.MapClaims{
+		"sub":                "idp-alice",
+		"preferred_username": "alice",
+		"email":              "Alice@Example.com",
+		"email_verified":     true,
+		"groups":             []string{"moderators", "unmapped"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Fatalf("provisioned user = %+v", user)
+	}
+	if !ContainsRole(user.Roles, RoleModerator) || ContainsRole(user.Roles, RoleManager) {
+		t.Fatalf("provisioned roles = %v, want only %s", user.Roles, RoleModerator)
+	}
+	identity, _ := fixture.identities.Find(stubIdpProvider, "idp-alice")
+	if identity.OwnerRefer != "alice" {
+		t.Fatalf("identity owner = %q, want alice", identity.OwnerRefer)
+	}
+	if managed, _ := fixture.service.ExternallyManaged("alice"); !managed {
+		t.Fatalf("provisioned account is not externally managed")
+	}
+
+	user, err = fixture.login(t, jwt.MapClaims{"sub": "idp-alice", "groups": []string{"moderators"}})
+	if err != nil || user.Username != "alice" {
+		t.Fatalf("second login = %v, %v", user, err)
+	}
+}
+
+func TestFederatedLoginRejectsReusedState(t *testing.T) {
+	fixture := newFederatedFixture(t)
+	login, err := fixture.service.Begin(stubIdpProvider, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := fixture.idp.authorize(t, login.AuthorizationUrl, jwt.MapClaims{"sub": "idp-alice"})
+
+	if _, err = fixture.service.Complete(stubIdpProvider, "forged-state", code); err != ErrInvalidFederatedState {
+		t.Fatalf("forged state err = %v, want %v", err, ErrInvalidFederatedState)
+	}
+	if _, err = fixture.service.Complete(stubIdpProvider, login.State, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fixture.service.Complete(stubIdpProvider, login.State, code); err != ErrInvalidFederatedState {
+		t.Fatalf("replayed state err = %v, want %v", err, ErrInvalidFederatedState)
+	}
+}
+
+func TestFederatedLoginRejectsNonceMismatch(t *testing.T) {
+	fixture := newFederatedFixture(t)
+
+	_, err := fixture.login(t, jwt.MapClaims{"sub": "idp-alice", "nonce": "replayed-nonce"})
+	if !errors.Is(err, ErrFederatedLoginFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrFederatedLoginFailed)
+	}
+	if _, err = fixture.users.FindByUsername("idp-alice"); err == nil {
+		t.Fatalf("user was provisioned from an id token with a foreign nonce")
+	}
+}
+
+func TestFederatedLoginSendsPkceVerifier(t *testing.T) {
+	fixture := newFederatedFixture(t)
+	login, err := fixture.service.Begin(stubIdpProvider, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := fixture.idp.authorize(t, login.AuthorizationUrl, jwt.MapClaims{"sub": "idp-alice"})
+	fixture.idp.grants[code].challenge = base64.RawURLEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	_, err = fixture.service.Complete(stubIdpProvider, login.State, code)
+	if !errors.Is(err, ErrFederatedLoginFailed) {
+		t.Fatalf("err = %v, want %v for a code bound to another challenge", err, ErrFederatedLoginFailed)
+	}
+}
+
+func TestFederatedLoginLinksVerifiedEmail(t *testing.T) {
+	fixture := newFederatedFixture(t,
+		&persist.User{Username: "bob", Email: "bob@example.com", EmailVerified: true},
+		&persist.User{Username: "carol", Email: "carol@example.com"},
+	)
+	fixture.provider.LinkVerifiedEmail = true
+	fixture.provider.AutoProvision = false
+
+	user, err := fixture.login(t, jwt.MapClaims{"sub": "idp-bob", "email": "bob@example.com", "email_verified": true})
+	if err != nil || user.Username != "bob" {
+		t.Fatalf("verified email login = %v, %v, want bob", user, err)
+	}
+	identity, _ := fixture.identities.Find(stubIdpProvider, "idp-bob")
+	if identity.OwnerRefer != "bob" {
+		t.Fatalf("identity owner = %q, want bob", identity.OwnerRefer)
+	}
+	if managed, _ := fixture.service.ExternallyManaged("bob"); managed {
+		t.Fatalf("linked local account is externally managed")
+	}
+
+	_, err = fixture.login(t, jwt.MapClaims{"sub": "idp-bob-2", "email": "bob@example.com", "email_verified": false})
+	if err != ErrFederatedIdentityNotLinked {
+		t.Fatalf("unverified idp email err = %v, want %v", err, ErrFederatedIdentityNotLinked)
+	}
+	_, err = fixture.login(t, jwt.MapClaims{"sub": "idp-carol", "email": "carol@example.com", "email_verified": true})
+	if err != ErrFederatedIdentityNotLinked {
+		t.Fatalf("unverified local email err = %v, want %v", err, ErrFederatedIdentityNotLinked)
+	}
+}
+
+func TestFederatedLoginRemovesGroupRoles(t *testing.T) {
+	fixture := newFederatedFixture(t, &persist.User{
+		Username: "dave",
+		Roles:    []persist.Role{{Name: RoleUser}, {Name: RoleModerator}, {Name: RoleManager}},
+	})
+	fixture.identities.Save(&persist.FederatedIdentity{Provider: stubIdpProvider, Subject: "idp-dave", OwnerRefer: "dave"})
+
+	user, err := fixture.login(t, jwt.MapClaims{"sub": "idp-dave", "groups": []string{"staff"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ContainsRole(user.Roles, RoleModerator) || !ContainsRole(user.Roles, RoleManager) ||
+		!ContainsRole(user.Roles, RoleUser) {
+		t.Fatalf("roles = %v, want %s removed and unmapped roles kept", user.Roles, RoleModerator)
+	}
+	if len(fixture.tokens.revoked) != 1 || fixture.tokens.revoked[0] != "dave" {
+		t.Fatalf("revoked sessions = %v, want dave after a role removal", fixture.tokens.revoked)
+	}
+
+	if _, err = fixture.login(t, jwt.MapClaims{"sub": "idp-dave", "groups": []string{"staff"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fixture.tokens.revoked) != 1 {
+		t.Fatalf("sessions revoked again without a role change: %v", fixture.tokens.revoked)
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"gin-auth/persist"
+	"sort"
+)
+
+type GroupRoleMapping map[string]string
+
+func ParseGroupRoleMapping(entries []string) (GroupRoleMapping, error) {
+	return parseRoleMapping(entries)
+}
+
+func (m GroupRoleMapping) Roles(groups []string) []persist.Role {
+	var roles []persist.Role
+	for _, group := range groups {
+		if role, ok := m[group]; ok && !ContainsRole(roles, role) {
+			roles = append(roles, persist.Role{Name: role})
+		}
+	}
+	return roles
+}
+
+func (m GroupRoleMapping) managedRoles() []string {
+	var managed []string
+	for _, role := range m {
+		if !containsString(managed, role) {
+			managed = append(managed, role)
+		}
+	}
+	sort.Strings(managed)
+	return managed
+}
+
+func syncGroupRoles(userRepo persist.UserRepository, tokenService TokenService, mapping GroupRoleMapping,
+	user *persist.User, groups []string) (*persist.User, error) {
+	if len(mapping) == 0 {
+		return user, nil
+	}
+	granted := mapping.Roles(groups)
+	changed, removed := false, false
+	for _, role := range mapping.managedRoles() {
+		has, want := ContainsRole(user.Roles, role), ContainsRole(granted, role)
+		var err error
+		if want && !has {
+			err = userRepo.AddRole(user.Username, role)
+			changed = true
+		} else if has && !want {
+			err = userRepo.RemoveRole(user.Username, role)
+			changed, removed = true, true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if removed {
+		err := tokenService.RevokeAll(user.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !changed {
+		return user, nil
+	}
+	return userRepo.FindByUsername(user.Username)
+}
@@ -1,12 +1,27 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
 
 const defaultCost = 10
 
+const (
+	EncoderBcrypt   = "bcrypt"
+	EncoderArgon2id = "argon2id"
+	EncoderScrypt   = "scrypt"
+)
+
+var errInvalidHash = errors.New("invalid password hash format")
+
 type PasswordEncoder interface {
 	Encode(password string) (string, error)
 	Compare(hash, raw string) bool
+	NeedsRehash(hash string) bool
 }
 
 type BcryptPasswordEncoder struct {
@@ -26,8 +41,94 @@ func (e *BcryptPasswordEncoder) Compare(hash, raw string) bool {
 	return err == nil
 }
 
+func (e *BcryptPasswordEncoder) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < e.cost
+}
+
 func NewBcryptPasswordEncoder() *BcryptPasswordEncoder {
 	return &BcryptPasswordEncoder{
 		cost: defaultCost,
 	}
 }
+
+type DelegatingPasswordEncoder struct {
+	defaultId string
+	encoders  map[string]PasswordEncoder
+}
+
+func (e *DelegatingPasswordEncoder) Encode(password string) (string, error) {
+	return e.encoders[e.defaultId].Encode(password)
+}
+
+func (e *DelegatingPasswordEncoder) Compare(hash, raw string) bool {
+	encoder, ok := e.encoders[encoderId(hash)]
+	if !ok {
+		return false
+	}
+	return encoder.Compare(hash, raw)
+}
+
+func (e *DelegatingPasswordEncoder) NeedsRehash(hash string) bool {
+	id := encoderId(hash)
+	if id != e.defaultId {
+		return true
+	}
+	return e.encoders[id].NeedsRehash(hash)
+}
+
+func NewDelegatingPasswordEncoder(defaultId string) *DelegatingPasswordEncoder {
+	encoders := map[string]PasswordEncoder{
+		EncoderBcrypt:   NewBcryptPasswordEncoder(),
+		EncoderArgon2id: NewArgon2idPasswordEncoder(),
+		EncoderScrypt:   NewScryptPasswordEncoder(),
+	}
+	if _, ok := encoders[defaultId]; !ok {
+		defaultId = EncoderArgon2id
+	}
+	return &DelegatingPasswordEncoder{
+		defaultId: defaultId,
+		encoders:  encoders,
+	}
+}
+
+func encoderId(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return EncoderBcrypt
+	case strings.HasPrefix(hash, "$"+EncoderArgon2id+"$"):
+		return EncoderArgon2id
+	case strings.HasPrefix(hash, "$"+EncoderScrypt+"$"):
+		return EncoderScrypt
+	default:
+		return ""
+	}
+}
+
+func generateSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func encodePhcHash(id, params string, salt, key []byte) string {
+	return "$" + id + "$" + params + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(key)
+}
+
+func decodePhcHash(hash string) (params []string, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 5 {
+		return nil, nil, nil, errInvalidHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+	return parts[2 : len(parts)-2], salt, key, nil
+}
@@ -0,0 +1,103 @@
+package jwt
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"math"
+	"time"
+)
+
+const AppClaimsUsername = "Username"
+const AppClaimsRoles = "Roles"
+const ClaimTokenUse = "token_use"
+const ClaimClientId = "client_id"
+const TokenUseId = "id"
+
+type AppClaims struct {
+	*jwt.RegisteredClaims
+	ID       uint
+	Username string
+	Roles    []string
+	Custom   map[string]interface{} `json:"-"`
+}
+
+type appClaimsJson AppClaims
+
+var registeredClaimNames = []string{"aud", "exp", "jti", "iat", "iss", "nbf", "sub",
+	"ID", AppClaimsUsername, AppClaimsRoles}
+
+func (c *AppClaims) MarshalJSON() ([]byte, error) {
+	bytes, err := json.Marshal((*appClaimsJson)(c))
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]interface{})
+	err = json.Unmarshal(bytes, &merged)
+	if err != nil {
+		return nil, err
+	}
+	if c.RegisteredClaims != nil && len(c.Audience) == 1 {
+		merged["aud"] = c.Audience[0]
+	}
+	if c.RegisteredClaims != nil && c.IssuedAt != nil {
+		merged["iat"] = float64(c.IssuedAt.UnixMilli()) / 1000
+	}
+	for name, value := range c.Custom {
+		if _, reserved := merged[name]; !reserved {
+			merged[name] = value
+		}
+	}
+	return json.Marshal(merged)
+}
+
+func (c *AppClaims) UnmarshalJSON(data []byte) error {
+	decoded := appClaimsJson{RegisteredClaims: &jwt.RegisteredClaims{}}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	custom := make(map[string]interface{})
+	err = json.Unmarshal(data, &custom)
+	if err != nil {
+		return err
+	}
+	if iat, ok := custom["iat"].(float64); ok {
+		decoded.IssuedAt = &jwt.NumericDate{Time: millisecondTime(iat)}
+	}
+	for _, name := range registeredClaimNames {
+		delete(custom, name)
+	}
+	*c = AppClaims(decoded)
+	if len(custom) > 0 {
+		c.Custom = custom
+	}
+	return nil
+}
+
+func millisecondTime(seconds float64) time.Time {
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(math.Round(fraction*1000))*int64(time.Millisecond))
+}
+
+type TokenOption func(claims *AppClaims)
+
+func WithSubject(subject string) TokenOption {
+	return func(claims *AppClaims) {
+		claims.Subject = subject
+	}
+}
+
+func WithAudience(audience ...string) TokenOption {
+	return func(claims *AppClaims) {
+		claims.Audience = audience
+	}
+}
+
+func WithClaim(name string, value interface{}) TokenOption {
+	return func(claims *AppClaims) {
+		if claims.Custom == nil {
+			claims.Custom = make(map[string]interface{})
+		}
+		claims.Custom[name] = value
+	}
+}
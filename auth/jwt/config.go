@@ -0,0 +1,38 @@
+package jwt
+
+import (
+	"gin-auth/persist"
+	"time"
+)
+
+const DefaultLeeway = time.Second * 30
+
+type ClaimsEnricher func(user *persist.User) map[string]interface{}
+
+type Config struct {
+	Issuer            string
+	Audience          string
+	AcceptedAudiences []string
+	TTL               time.Duration
+	Leeway            time.Duration
+	ClaimsEnrichers   []ClaimsEnricher
+}
+
+func (c *Config) MaxTokenLifetime() time.Duration {
+	return c.TTL + c.Leeway
+}
+
+func (c *Config) acceptedAudiences() []string {
+	if len(c.AcceptedAudiences) == 0 && c.Audience != "" {
+		return []string{c.Audience}
+	}
+	return c.AcceptedAudiences
+}
+
+func DefaultConfig(issuer string) *Config {
+	return &Config{
+		Issuer: issuer,
+		TTL:    AccessTokenTTL,
+		Leeway: DefaultLeeway,
+	}
+}
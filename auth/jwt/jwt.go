@@ -1,66 +1,238 @@
 package jwt
 
 import (
+	"errors"
 	"fmt"
 	"gin-auth/persist"
-	"github.com/dgrijalva/jwt-go"
+	"gin-auth/util"
+	"github.com/golang-jwt/jwt/v5"
+	"sync"
 	"time"
 )
 
 type JwtService interface {
-	GenerateToken(user *persist.User) string
-	VerifyToken(token string) (*jwt.Token, error)
+	GenerateToken(user *persist.User, options ...TokenOption) (string, error)
+	VerifyToken(token string) (*AppClaims, error)
+	VerifyIdToken(token string) (*AppClaims, error)
+	RevokeToken(claims *AppClaims) error
+	RevokeAllTokens(username string) error
+	RevokeClientTokens(username, clientId string) error
+	TokenTTL() time.Duration
+	SigningAlgorithm() string
+	Jwks() *Jwks
+	RotateKeys() (string, error)
+	AddClaimsEnricher(enricher ClaimsEnricher)
 }
 
 type jwtService struct {
-	Secret []byte
-	Issuer string
+	KeyRing     *KeyRing
+	Config      *Config
+	revocations persist.TokenRevocationRepository
+	parser      *jwt.Parser
+	hintParser  *jwt.Parser
+	mu          sync.RWMutex
 }
 
-const AppClaimsUsername = "Username"
-const AppClaimsRoles = "Roles"
+const AccessTokenTTL = time.Minute * 15
+const tokenIdSize = 16
 
-type AppClaims struct {
-	*jwt.StandardClaims
-	ID       uint
-	Username string
-	Roles    []string
-}
+var ErrTokenRevoked = errors.New("token revoked")
+var ErrIdTokenNotAccepted = errors.New("id tokens are not accepted as access tokens")
+var ErrNotIdToken = errors.New("token is not an id token")
 
-func (s *jwtService) GenerateToken(user *persist.User) string {
+func (s *jwtService) GenerateToken(user *persist.User, options ...TokenOption) (string, error) {
+	jti, err := util.GenerateRandomToken(tokenIdSize)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &AppClaims{
-		StandardClaims: &jwt.StandardClaims{
+		RegisteredClaims: &jwt.RegisteredClaims{
+			ID:        jti,
 			Subject:   user.Username,
-			ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
-			Issuer:    s.Issuer,
-			IssuedAt:  time.Now().Unix(),
+			Audience:  audience(s.Config.Audience),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.Config.TTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    s.Config.Issuer,
+			IssuedAt:  &jwt.NumericDate{Time: now},
 		},
 		ID:       user.ID,
 		Username: user.Username,
 		Roles:    rolesToString(user.Roles),
+		Custom:   s.customClaims(user),
+	}
+	for _, option := range options {
+		option(claims)
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenStr, err := token.SignedString(s.Secret)
+	signingKey := s.KeyRing.Current()
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.Kid
+	return token.SignedString(signingKey.Private)
+}
+
+func (s *jwtService) VerifyToken(token string) (*AppClaims, error) {
+	claims := &AppClaims{}
+	_, err := s.parser.ParseWithClaims(token, claims, s.verificationKey)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if claims.Custom[ClaimTokenUse] == TokenUseId {
+		return nil, ErrIdTokenNotAccepted
+	}
+	err = s.checkRevocation(claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *jwtService) VerifyIdToken(token string) (*AppClaims, error) {
+	claims := &AppClaims{}
+	_, err := s.hintParser.ParseWithClaims(token, claims, s.verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != s.Config.Issuer {
+		return nil, fmt.Errorf("invalid token, iss: %s", claims.Issuer)
+	}
+	if claims.Custom[ClaimTokenUse] != TokenUseId {
+		return nil, ErrNotIdToken
 	}
-	return tokenStr
+	return claims, nil
 }
 
-func (s *jwtService) VerifyToken(token string) (*jwt.Token, error) {
-	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, valid := token.Method.(*jwt.SigningMethodHMAC); !valid {
-			return nil, fmt.Errorf("invalid token, alg: %s", token.Header["alg"])
+func (s *jwtService) RevokeToken(claims *AppClaims) error {
+	if claims.RegisteredClaims == nil || claims.RegisteredClaims.ID == "" {
+		return errors.New("token has no id")
+	}
+	return s.revocations.Revoke(claims.RegisteredClaims.ID, claims.ExpiresAt.Time)
+}
+
+func (s *jwtService) RevokeAllTokens(username string) error {
+	return s.revocations.RevokeAllBefore(username, time.Now())
+}
+
+func (s *jwtService) RevokeClientTokens(username, clientId string) error {
+	return s.revocations.RevokeAllBefore(clientRevocationSubject(username, clientId), time.Now())
+}
+
+func (s *jwtService) TokenTTL() time.Duration {
+	return s.Config.TTL
+}
+
+func (s *jwtService) SigningAlgorithm() string {
+	return s.KeyRing.Current().Method.Alg()
+}
+
+func (s *jwtService) AddClaimsEnricher(enricher ClaimsEnricher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Config.ClaimsEnrichers = append(s.Config.ClaimsEnrichers, enricher)
+}
+
+func (s *jwtService) Jwks() *Jwks {
+	jwks := &Jwks{Keys: []Jwk{}}
+	for _, key := range s.KeyRing.Keys() {
+		jwk, err := publicJwk(key)
+		if err == nil {
+			jwks.Keys = append(jwks.Keys, *jwk)
 		}
-		return s.Secret, nil
-	})
+	}
+	return jwks
 }
 
-func NewJwtService(secret, issuer string) JwtService {
+func (s *jwtService) RotateKeys() (string, error) {
+	key, err := s.KeyRing.Rotate()
+	if err != nil {
+		return "", err
+	}
+	return key.Kid, nil
+}
+
+func (s *jwtService) customClaims(user *persist.User) map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	custom := make(map[string]interface{})
+	for _, enricher := range s.Config.ClaimsEnrichers {
+		for name, value := range enricher(user) {
+			custom[name] = value
+		}
+	}
+	return custom
+}
+
+func (s *jwtService) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = hmacKeyId
+	}
+	key, ok := s.KeyRing.Find(kid)
+	if !ok {
+		return nil, fmt.Errorf("invalid token, unknown kid: %s", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("invalid token, alg: %s", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+func (s *jwtService) checkRevocation(claims *AppClaims) error {
+	if claims.RegisteredClaims.ID != "" {
+		revoked, err := s.revocations.IsRevoked(claims.RegisteredClaims.ID)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+	subjects := []string{claims.Subject}
+	if clientId, ok := claims.Custom[ClaimClientId].(string); ok && clientId != "" {
+		subjects = append(subjects, clientRevocationSubject(claims.Subject, clientId))
+	}
+	for _, subject := range subjects {
+		revokedBefore, err := s.revocations.RevokedBefore(subject)
+		if err != nil {
+			return err
+		}
+		if revokedBefore.IsZero() {
+			continue
+		}
+		if claims.IssuedAt == nil || claims.IssuedAt.Before(revokedBefore) {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
+
+func clientRevocationSubject(username, clientId string) string {
+	return clientId + "\x00" + username
+}
+
+func NewJwtService(keyRing *KeyRing, config *Config, revocations persist.TokenRevocationRepository) JwtService {
+	options := []jwt.ParserOption{
+		jwt.WithLeeway(config.Leeway),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if audiences := config.acceptedAudiences(); len(audiences) > 0 {
+		options = append(options, jwt.WithAudience(audiences...))
+	}
 	return &jwtService{
-		Secret: []byte(secret),
-		Issuer: issuer,
+		KeyRing:     keyRing,
+		Config:      config,
+		revocations: revocations,
+		parser:      jwt.NewParser(options...),
+		hintParser:  jwt.NewParser(jwt.WithoutClaimsValidation()),
+	}
+}
+
+func audience(aud string) jwt.ClaimStrings {
+	if aud == "" {
+		return nil
 	}
+	return jwt.ClaimStrings{aud}
 }
 
 func rolesToString(roles []persist.Role) []string {
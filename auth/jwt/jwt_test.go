@@ -0,0 +1,142 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"gin-auth/persist"
+	"github.com/golang-jwt/jwt/v5"
+	"testing"
+	"time"
+)
+
+const testIssuer = "gin-auth-test"
+
+func newTestJwtService(ring *KeyRing) JwtService {
+	return NewJwtService(ring, DefaultConfig(testIssuer), persist.NewTokenRevocationMemoryRepository())
+}
+
+func TestRevokeAllTokensThenReissue(t *testing.T) {
+	service := newTestJwtService(NewKeyRing(NewHmacSigningKey("secret"), time.Minute))
+	user := &persist.User{Username: "alice"}
+
+	old, err := service.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 2)
+	if err = service.RevokeAllTokens(user.Username); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		reissued, err := service.GenerateToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = service.VerifyToken(reissued); err != nil {
+			t.Fatalf("token issued right after revoking all tokens was rejected: %v", err)
+		}
+	}
+	if _, err = service.VerifyToken(old); err != ErrTokenRevoked {
+		t.Fatalf("token issued before revoking all tokens err = %v, want %v", err, ErrTokenRevoked)
+	}
+}
+
+func TestVerifyTokenLooksUpKid(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := NewAsymmetricSigningKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verification, err := newPublicSigningKey(private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newTestJwtService(NewKeyRing(NewHmacSigningKey("secret"), time.Minute, verification))
+	other := newTestJwtService(NewKeyRing(external, time.Minute))
+	user := &persist.User{Username: "alice"}
+
+	token, err := other.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(token); err != nil {
+		t.Fatalf("token signed with a verification key rejected: %v", err)
+	}
+	if _, err = other.RotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	token, err = other.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(token); err == nil {
+		t.Fatal("token with an unknown kid was accepted")
+	}
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"})
+	forged.Header["kid"] = verification.Kid
+	signed, err := forged.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(signed); err == nil {
+		t.Fatal("token with an algorithm other than its key's was accepted")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	service := newTestJwtService(NewKeyRing(NewHmacSigningKey("secret"), time.Minute))
+	user := &persist.User{Username: "alice"}
+
+	revoked, err := service.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := service.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := service.VerifyToken(revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = service.RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(revoked); err != ErrTokenRevoked {
+		t.Fatalf("revoked token err = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err = service.VerifyToken(kept); err != nil {
+		t.Fatalf("other token rejected: %v", err)
+	}
+}
+
+func TestVerifyTokenWithoutKid(t *testing.T) {
+	service := newTestJwtService(NewKeyRing(NewHmacSigningKey("secret"), time.Minute))
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "alice",
+		"iss": testIssuer,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"iat": time.Now().Unix(),
+	})
+	token, err := legacy.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(token); err != nil {
+		t.Fatalf("token without kid rejected: %v", err)
+	}
+	if _, err = service.RotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.VerifyToken(token); err != nil {
+		t.Fatalf("token without kid rejected after rotation: %v", err)
+	}
+	service.(*jwtService).KeyRing.retireAt[hmacKeyId] = time.Now().Add(-time.Second)
+	if _, err = service.VerifyToken(token); err == nil {
+		t.Fatal("token without kid accepted after the configured key retired")
+	}
+}
@@ -0,0 +1,249 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"gin-auth/util"
+	"sync"
+	"time"
+)
+
+const rsaKeyBits = 2048
+const hmacSecretSize = 32
+const hmacKeyIdSize = 12
+const keyReloadInterval = time.Second
+
+type KeyRing struct {
+	mu           sync.RWMutex
+	current      *SigningKey
+	configured   *SigningKey
+	currentSince time.Time
+	keys         map[string]*SigningKey
+	retireAt     map[string]time.Time
+	retention    time.Duration
+	store        *KeyStore
+	loadedAt     time.Time
+}
+
+func (r *KeyRing) Current() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+func (r *KeyRing) Find(kid string) (*SigningKey, bool) {
+	key, ok := r.find(kid)
+	if !ok && r.store != nil && r.reloadDue() {
+		if err := r.Reload(); err == nil {
+			key, ok = r.find(kid)
+		}
+	}
+	return key, ok
+}
+
+func (r *KeyRing) find(kid string) (*SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	if retireAt, retiring := r.retireAt[kid]; retiring && time.Now().After(retireAt) {
+		return nil, false
+	}
+	return key, true
+}
+
+func (r *KeyRing) Keys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for kid, key := range r.keys {
+		if retireAt, retiring := r.retireAt[kid]; retiring && now.After(retireAt) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *KeyRing) Rotate() (*SigningKey, error) {
+	current := r.Current()
+	key, err := generateSigningKey(current)
+	if err != nil {
+		return nil, err
+	}
+	if r.store != nil {
+		err = r.store.rotate(key, current.Kid, time.Now().Add(r.retention))
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.Add(key)
+	return key, nil
+}
+
+func (r *KeyRing) Reload() error {
+	stored, err := r.store.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	initial := r.loadedAt.IsZero()
+	r.loadedAt = time.Now()
+	for kid, key := range stored.keys {
+		r.keys[kid] = key
+	}
+	for kid, retireAt := range stored.retireAt {
+		r.retireAt[kid] = retireAt
+	}
+	switch {
+	case initial:
+		if stored.current != nil && stored.current.Kid != r.configured.Kid {
+			retireAt := r.loadedAt.Add(r.retention)
+			err = r.store.reinstate(r.configured.Kid, stored.current.Kid, retireAt)
+			if err != nil {
+				return err
+			}
+			r.retireAt[stored.current.Kid] = retireAt
+		}
+	case stored.current != nil && stored.current.Kid != r.current.Kid:
+		r.current = stored.current
+		r.currentSince = stored.currentSince
+	case stored.current == nil && r.current != r.configured:
+		if _, retiring := r.retireAt[r.current.Kid]; retiring {
+			r.current = r.configured
+			r.currentSince = r.loadedAt
+		}
+	}
+	delete(r.retireAt, r.current.Kid)
+	return nil
+}
+
+func (r *KeyRing) reloadDue() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return time.Since(r.loadedAt) > keyReloadInterval
+}
+
+func (r *KeyRing) Add(key *SigningKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for kid, retireAt := range r.retireAt {
+		if now.After(retireAt) {
+			delete(r.keys, kid)
+			delete(r.retireAt, kid)
+		}
+	}
+	r.retireAt[r.current.Kid] = now.Add(r.retention)
+	r.current = key
+	r.currentSince = now
+	r.keys[key.Kid] = key
+}
+
+func (r *KeyRing) rotationDue(interval time.Duration) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return time.Since(r.currentSince) >= interval/2
+}
+
+func (r *KeyRing) StartRotation(interval time.Duration, onError func(err error)) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if r.store != nil {
+					if err := r.Reload(); err != nil && onError != nil {
+						onError(err)
+					}
+				}
+				if !r.rotationDue(interval) {
+					continue
+				}
+				if _, err := r.Rotate(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func NewKeyRing(current *SigningKey, retention time.Duration, verificationKeys ...*SigningKey) *KeyRing {
+	keys := map[string]*SigningKey{current.Kid: current}
+	for _, key := range verificationKeys {
+		keys[key.Kid] = key
+	}
+	return &KeyRing{
+		current:      current,
+		configured:   current,
+		currentSince: time.Now(),
+		keys:         keys,
+		retireAt:     make(map[string]time.Time),
+		retention:    retention,
+	}
+}
+
+func NewPersistentKeyRing(store *KeyStore, current *SigningKey, retention time.Duration,
+	verificationKeys ...*SigningKey) (*KeyRing, error) {
+	ring := NewKeyRing(current, retention, verificationKeys...)
+	ring.store = store
+	err := ring.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func generateSigningKey(template *SigningKey) (*SigningKey, error) {
+	switch public := template.Public.(type) {
+	case []byte:
+		secret, err := util.GenerateRandomToken(hmacSecretSize)
+		if err != nil {
+			return nil, err
+		}
+		kid, err := util.GenerateRandomToken(hmacKeyIdSize)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{
+			Kid:     kid,
+			Method:  template.Method,
+			Private: []byte(secret),
+			Public:  []byte(secret),
+		}, nil
+	case *rsa.PublicKey:
+		private, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		return NewAsymmetricSigningKey(private)
+	case *ecdsa.PublicKey:
+		private, err := ecdsa.GenerateKey(public.Curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewAsymmetricSigningKey(private)
+	case ed25519.PublicKey:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewAsymmetricSigningKey(private)
+	default:
+		return nil, errors.New("unsupported signing key type")
+	}
+}
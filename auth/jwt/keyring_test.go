@@ -0,0 +1,155 @@
+package jwt
+
+import (
+	"gin-auth/persist"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySigningKeyRepository struct {
+	mu   sync.Mutex
+	keys []*persist.SigningKey
+}
+
+func (repo *memorySigningKeyRepository) FindAll() ([]*persist.SigningKey, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	keys := make([]*persist.SigningKey, 0, len(repo.keys))
+	for _, key := range repo.keys {
+		stored := *key
+		keys = append(keys, &stored)
+	}
+	return keys, nil
+}
+
+func (repo *memorySigningKeyRepository) Rotate(key *persist.SigningKey, retiringKid string, retireAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	retiring := repo.find(retiringKid)
+	if retiring == nil {
+		retiring = &persist.SigningKey{Kid: retiringKid}
+		repo.keys = append(repo.keys, retiring)
+	}
+	retiring.Current = false
+	retiring.RetireAt = &retireAt
+	stored := *key
+	stored.CreatedAt = time.Now()
+	repo.keys = append(repo.keys, &stored)
+	return nil
+}
+
+func (repo *memorySigningKeyRepository) Reinstate(kid, retiringKid string, retireAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	keys := repo.keys[:0]
+	for _, key := range repo.keys {
+		if key.Kid != kid || len(key.PrivateKey) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	repo.keys = keys
+	if retiring := repo.find(retiringKid); retiring != nil {
+		retiring.Current = false
+		retiring.RetireAt = &retireAt
+	}
+	return nil
+}
+
+func (repo *memorySigningKeyRepository) find(kid string) *persist.SigningKey {
+	for _, key := range repo.keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func newTestKeyRing(t *testing.T, repo persist.SigningKeyRepository, retention time.Duration) *KeyRing {
+	store, err := NewKeyStore(repo, "key-encryption-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := NewPersistentKeyRing(store, NewHmacSigningKey("secret"), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestKeyRingRotateRestartRetire(t *testing.T) {
+	repo := &memorySigningKeyRepository{}
+	retention := time.Millisecond * 200
+	service := newTestJwtService(newTestKeyRing(t, repo, retention))
+	user := &persist.User{Username: "alice"}
+
+	configuredToken, err := service.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKid, err := service.RotateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedToken, err := service.GenerateToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{configuredToken, rotatedToken} {
+		if _, err = service.VerifyToken(token); err != nil {
+			t.Fatalf("token rejected after rotation: %v", err)
+		}
+	}
+
+	restarted := newTestJwtService(newTestKeyRing(t, repo, retention))
+	if kid := restarted.(*jwtService).KeyRing.Current().Kid; kid != hmacKeyId {
+		t.Fatalf("current kid after restart = %s, want the configured %s", kid, hmacKeyId)
+	}
+	for _, token := range []string{configuredToken, rotatedToken} {
+		if _, err = restarted.VerifyToken(token); err != nil {
+			t.Fatalf("token rejected after restart: %v", err)
+		}
+	}
+	stored := repo.find(rotatedKid)
+	if stored == nil || stored.Current || stored.RetireAt == nil {
+		t.Fatalf("rotated key after restart = %+v, want it retiring", stored)
+	}
+
+	time.Sleep(retention + time.Millisecond*50)
+	if _, err = restarted.VerifyToken(rotatedToken); err == nil {
+		t.Fatal("token signed with a retired key was accepted")
+	}
+	if _, err = restarted.VerifyToken(configuredToken); err != nil {
+		t.Fatalf("token signed with the configured key rejected: %v", err)
+	}
+}
+
+func TestKeyRingReloadFollowsPeers(t *testing.T) {
+	repo := &memorySigningKeyRepository{}
+	first := newTestKeyRing(t, repo, time.Minute)
+	second := newTestKeyRing(t, repo, time.Minute)
+
+	rotated, err := first.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid := second.Current().Kid; kid != rotated.Kid {
+		t.Fatalf("current kid after a peer rotated = %s, want %s", kid, rotated.Kid)
+	}
+
+	newTestKeyRing(t, repo, time.Minute)
+	for _, ring := range []*KeyRing{first, second} {
+		if err = ring.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if kid := ring.Current().Kid; kid != hmacKeyId {
+			t.Fatalf("current kid after a peer restarted = %s, want %s", kid, hmacKeyId)
+		}
+		if _, ok := ring.Find(rotated.Kid); !ok {
+			t.Fatalf("retiring key %s is no longer available for verification", rotated.Kid)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gin-auth/persist"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+type KeyStore struct {
+	repo persist.SigningKeyRepository
+	aead cipher.AEAD
+}
+
+type storedKeys struct {
+	current      *SigningKey
+	currentSince time.Time
+	keys         map[string]*SigningKey
+	retireAt     map[string]time.Time
+}
+
+func (s *KeyStore) load() (*storedKeys, error) {
+	records, err := s.repo.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stored := &storedKeys{
+		keys:     make(map[string]*SigningKey),
+		retireAt: make(map[string]time.Time),
+	}
+	for _, record := range records {
+		if record.RetireAt != nil {
+			stored.retireAt[record.Kid] = *record.RetireAt
+			if now.After(*record.RetireAt) {
+				continue
+			}
+		}
+		if len(record.PrivateKey) == 0 {
+			continue
+		}
+		key, err := s.decrypt(record)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", record.Kid, err)
+		}
+		stored.keys[key.Kid] = key
+		if record.Current {
+			stored.current = key
+			stored.currentSince = record.CreatedAt
+		}
+	}
+	return stored, nil
+}
+
+func (s *KeyStore) rotate(key *SigningKey, retiringKid string, retireAt time.Time) error {
+	record, err := s.encrypt(key)
+	if err != nil {
+		return err
+	}
+	record.Current = true
+	return s.repo.Rotate(record, retiringKid, retireAt)
+}
+
+func (s *KeyStore) reinstate(kid, retiringKid string, retireAt time.Time) error {
+	return s.repo.Reinstate(kid, retiringKid, retireAt)
+}
+
+func (s *KeyStore) encrypt(key *SigningKey) (*persist.SigningKey, error) {
+	var plain []byte
+	switch private := key.Private.(type) {
+	case []byte:
+		plain = private
+	case crypto.Signer:
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		plain = der
+	default:
+		return nil, errors.New("signing key has no private material")
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &persist.SigningKey{
+		Kid:        key.Kid,
+		Algorithm:  key.Method.Alg(),
+		PrivateKey: s.aead.Seal(nonce, nonce, plain, []byte(key.Kid)),
+	}, nil
+}
+
+func (s *KeyStore) decrypt(record *persist.SigningKey) (*SigningKey, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(record.PrivateKey) < nonceSize {
+		return nil, errors.New("encrypted key is too short")
+	}
+	plain, err := s.aead.Open(nil, record.PrivateKey[:nonceSize], record.PrivateKey[nonceSize:], []byte(record.Kid))
+	if err != nil {
+		return nil, errors.New("cannot decrypt, check the key encryption key")
+	}
+	method := jwt.GetSigningMethod(record.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported algorithm: %s", record.Algorithm)
+	}
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		return &SigningKey{Kid: record.Kid, Method: method, Private: plain, Public: plain}, nil
+	}
+	private, err := parsePrivateKey(plain)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewAsymmetricSigningKey(private)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kid != record.Kid {
+		return nil, errors.New("key id does not match the key material")
+	}
+	key.Method = method
+	return key, nil
+}
+
+func NewKeyStore(repo persist.SigningKeyRepository, secret string) (*KeyStore, error) {
+	if secret == "" {
+		return nil, errors.New("key encryption secret is required")
+	}
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{repo: repo, aead: aead}, nil
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gin-auth/persist"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const LdapProvider = "ldap"
+
+var ErrLdapEntryNotFound = errors.New("ldap entry not found or not unique")
+var ErrLdapUnavailable = errors.New("ldap directory is unavailable")
+
+type LdapConfig struct {
+	Url                string
+	StartTLS           bool
+	CACertFile         string
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	UserDNTemplate     string
+	BaseDN             string
+	UserFilter         string
+	UsernameAttribute  string
+	EmailAttribute     string
+	GroupsAttribute    string
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupRoles         GroupRoleMapping
+	Timeout            time.Duration
+}
+
+func DefaultLdapConfig() *LdapConfig {
+	return &LdapConfig{
+		UserFilter:        "(uid=%s)",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		GroupsAttribute:   "memberOf",
+		GroupFilter:       "(member=%s)",
+		Timeout:           time.Second * 10,
+	}
+}
+
+type ldapEntry struct {
+	dn       string
+	username string
+	email    string
+	groups   []string
+}
+
+type LdapLoginService struct {
+	userRepo     persist.UserRepository
+	identityRepo persist.FederatedIdentityRepository
+	passEncoder  PasswordEncoder
+	tokenService TokenService
+	config       *LdapConfig
+	tlsConfig    *tls.Config
+}
+
+func (s *LdapLoginService) Login(username, password string) (*persist.User, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	entry, err := s.authenticate(username, password)
+	if err == ErrInvalidCredentials || err == ErrLdapEntryNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLdapUnavailable, err)
+	}
+	user, err := s.localUser(entry)
+	if err != nil {
+		return nil, err
+	}
+	return syncGroupRoles(s.userRepo, s.tokenService, s.config.GroupRoles, user, entry.groups)
+}
+
+func (s *LdapLoginService) authenticate(username, password string) (*ldapEntry, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	filter := fmt.Sprintf(s.config.UserFilter, ldap.EscapeFilter(username))
+	var entry *ldap.Entry
+	if s.config.UserDNTemplate != "" {
+		dn := fmt.Sprintf(s.config.UserDNTemplate, ldap.EscapeDN(username))
+		err = userBind(conn, dn, password)
+		if err != nil {
+			return nil, err
+		}
+		if s.config.BaseDN != "" {
+			entry, err = s.searchEntry(conn, s.config.BaseDN, ldap.ScopeWholeSubtree, filter)
+		} else {
+			entry, err = s.searchEntry(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)")
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = s.serviceBind(conn)
+		if err != nil {
+			return nil, err
+		}
+		entry, err = s.searchEntry(conn, s.config.BaseDN, ldap.ScopeWholeSubtree, filter)
+		if err != nil {
+			return nil, err
+		}
+		err = userBind(conn, entry.DN, password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups, err := s.groups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+	resolved := &ldapEntry{
+		dn:       strings.ToLower(entry.DN),
+		username: entry.GetAttributeValue(s.config.UsernameAttribute),
+		email:    strings.ToLower(entry.GetAttributeValue(s.config.EmailAttribute)),
+		groups:   groups,
+	}
+	if resolved.username == "" {
+		resolved.username = username
+	}
+	return resolved, nil
+}
+
+func (s *LdapLoginService) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if s.config.GroupBaseDN == "" {
+		var groups []string
+		for _, groupDN := range entry.GetAttributeValues(s.config.GroupsAttribute) {
+			if name := ldapCommonName(groupDN); name != "" {
+				groups = append(groups, name)
+			}
+		}
+		return groups, nil
+	}
+	if s.config.BindDN != "" {
+		err := s.serviceBind(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(s.config.GroupBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, int(s.config.Timeout.Seconds()), false,
+		fmt.Sprintf(s.config.GroupFilter, ldap.EscapeFilter(entry.DN)), []string{"cn"}, nil))
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, group := range result.Entries {
+		if name := group.GetAttributeValue("cn"); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+func (s *LdapLoginService) searchEntry(conn *ldap.Conn, baseDN string, scope int, filter string) (*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 2,
+		int(s.config.Timeout.Seconds()), false, filter,
+		[]string{s.config.UsernameAttribute, s.config.EmailAttribute, s.config.GroupsAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrLdapEntryNotFound
+	}
+	return result.Entries[0], nil
+}
+
+func (s *LdapLoginService) serviceBind(conn *ldap.Conn) error {
+	if s.config.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(s.config.BindDN, s.config.BindPassword)
+}
+
+func userBind(conn *ldap.Conn, dn, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+func (s *LdapLoginService) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(s.config.Url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: s.config.Timeout}),
+		ldap.DialWithTLSConfig(s.tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(s.config.Timeout)
+	if s.config.StartTLS {
+		err = conn.StartTLS(s.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *LdapLoginService) localUser(entry *ldapEntry) (*persist.User, error) {
+	identity, err := s.identityRepo.Find(LdapProvider, entry.dn)
+	if err != nil {
+		return nil, err
+	}
+	if identity.ID != 0 {
+		return s.userRepo.FindByUsername(identity.OwnerRefer)
+	}
+	if _, err := s.userRepo.FindByUsername(entry.username); err == nil {
+		return nil, ErrFederatedUsernameTaken
+	}
+	password, err := newRandomPasswordHash(s.passEncoder)
+	if err != nil {
+		return nil, err
+	}
+	user := &persist.User{Username: entry.username, Password: password}
+	if entry.email != "" {
+		if _, err := s.userRepo.FindByEmail(entry.email); err != nil {
+			user.Email = entry.email
+			user.EmailVerified = true
+		}
+	}
+	err = s.userRepo.Save(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, s.identityRepo.Save(&persist.FederatedIdentity{
+		Provider:    LdapProvider,
+		Subject:     entry.dn,
+		Email:       entry.email,
+		Provisioned: true,
+		OwnerRefer:  user.Username,
+	})
+}
+
+func ldapCommonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return ""
+	}
+	for _, rdn := range parsed.RDNs {
+		for _, attribute := range rdn.Attributes {
+			if strings.EqualFold(attribute.Type, "cn") {
+				return attribute.Value
+			}
+		}
+	}
+	return ""
+}
+
+func newLdapTLSConfig(config *LdapConfig) (*tls.Config, error) {
+	parsed, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         parsed.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func NewLdapLoginService(userRepo persist.UserRepository, identityRepo persist.FederatedIdentityRepository,
+	passEncoder PasswordEncoder, tokenService TokenService, config *LdapConfig) (LoginService, error) {
+	if config.Url == "" {
+		return nil, errors.New("ldap url is required")
+	}
+	if config.UserDNTemplate == "" && config.BaseDN == "" {
+		return nil, errors.New("ldap requires either a user dn template or a base dn to search")
+	}
+	if config.StartTLS && strings.HasPrefix(config.Url, "ldaps://") {
+		return nil, errors.New("ldap start tls cannot be used with an ldaps url")
+	}
+	tlsConfig, err := newLdapTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &LdapLoginService{
+		userRepo:     userRepo,
+		identityRepo: identityRepo,
+		passEncoder:  passEncoder,
+		tokenService: tokenService,
+		config:       config,
+		tlsConfig:    tlsConfig,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jimlambrt/gldap"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const ldapTestServiceDN = "cn=svc,dc=corp"
+const ldapTestServicePassword = "svcpw"
+
+type ldapTestUser struct {
+	password string
+	uid      string
+	mail     string
+	groups   []string
+}
+
+var ldapTestUsers = map[string]*ldapTestUser{
+	"uid=carol,ou=people,dc=corp": {
+		password: "carolpw",
+		uid:      "carol",
+		mail:     "Carol@Corp.example",
+		groups:   []string{"cn=mods,ou=groups,dc=corp", "cn=staff,ou=groups,dc=corp"},
+	},
+}
+
+func startLdapStub(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server, err := gldap.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := gldap.NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Bind(ldapStubBind)
+	mux.Search(ldapStubSearch)
+	server.Router(mux)
+	go server.Run(addr)
+	t.Cleanup(func() { server.Stop() })
+	for i := 0; i < 50 && !server.Ready(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	return "ldap://" + addr
+}
+
+func ldapStubBind(w *gldap.ResponseWriter, r *gldap.Request) {
+	response := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(response)
+	message, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	if message.UserName == ldapTestServiceDN && string(message.Password) == ldapTestServicePassword {
+		response.SetResultCode(gldap.ResultSuccess)
+		return
+	}
+	user, ok := ldapTestUsers[strings.ToLower(message.UserName)]
+	if ok && string(message.Password) == user.password {
+		response.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func ldapStubSearch(w *gldap.ResponseWriter, r *gldap.Request) {
+	response := r.NewSearchDoneResponse()
+	defer w.Write(response)
+	message, err := r.GetSearchMessage()
+	if err != nil {
+		response.SetResultCode(gldap.ResultOperationsError)
+		return
+	}
+	for dn, user := range ldapTestUsers {
+		if strings.Contains(message.Filter, "(uid="+user.uid+")") || strings.EqualFold(message.BaseDN, dn) {
+			w.Write(r.NewSearchResponseEntry(dn, gldap.WithAttributes(map[string][]string{
+				"uid":      {user.uid},
+				"mail":     {user.mail},
+				"memberOf": user.groups,
+			})))
+		}
+	}
+	response.SetResultCode(gldap.ResultSuccess)
+}
+
+func newLdapTestService(t *testing.T, url string, users *memoryUserRepository) (LoginService, *revocationRecorder) {
+	config := DefaultLdapConfig()
+	config.Url = url
+	config.BaseDN = "ou=people,dc=corp"
+	config.BindDN = ldapTestServiceDN
+	config.BindPassword = ldapTestServicePassword
+	config.GroupRoles = GroupRoleMapping{"mods": RoleModerator, "managers": RoleManager}
+	config.Timeout = time.Second
+	tokens := &revocationRecorder{}
+	service, err := NewLdapLoginService(users, &memoryFederatedIdentityRepository{},
+		&slowPasswordEncoder{version: "v1"}, tokens, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service, tokens
+}
+
+func TestLdapLoginProvisionsUser(t *testing.T) {
+	users := newMemoryUserRepository()
+	service, _ := newLdapTestService(t, startLdapStub(t), users)
+
+	user, err := service.Login("carol", "carolpw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "carol" || user.Email != "carol@corp.example" || !user.EmailVerified {
+		t.Fatalf("provisioned user = %+v", user)
+	}
+	if !ContainsRole(user.Roles, RoleModerator) || ContainsRole(user.Roles, RoleManager) {
+		t.Fatalf("provisioned roles = %v, want only %s", user.Roles, RoleModerator)
+	}
+	if _, err = service.Login("carol", "carolpw"); err != nil {
+		t.Fatalf("second login failed: %v", err)
+	}
+}
+
+func TestLdapLoginRejectsInvalidCredentials(t *testing.T) {
+	service, _ := newLdapTestService(t, startLdapStub(t), newMemoryUserRepository())
+
+	for _, credentials := range [][2]string{
+		{"carol", "wrong"},
+		{"carol", ""},
+		{"nobody", "carolpw"},
+		{"carol)(uid=*", "carolpw"},
+	} {
+		_, err := service.Login(credentials[0], credentials[1])
+		if err != ErrInvalidCredentials {
+			t.Errorf("login(%q, %q) err = %v, want %v", credentials[0], credentials[1], err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestLdapLoginReportsUnavailableDirectory(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("ldap://%s", listener.Addr())
+	listener.Close()
+	service, _ := newLdapTestService(t, url, newMemoryUserRepository())
+
+	_, err = service.Login("carol", "carolpw")
+	if !errors.Is(err, ErrLdapUnavailable) {
+		t.Fatalf("err = %v, want %v", err, ErrLdapUnavailable)
+	}
+}
+
+func TestLdapLoginReportsServiceBindFailure(t *testing.T) {
+	users := newMemoryUserRepository()
+	service, _ := newLdapTestService(t, startLdapStub(t), users)
+	service.(*LdapLoginService).config.BindPassword = "rotated"
+
+	_, err := service.Login("carol", "carolpw")
+	if !errors.Is(err, ErrLdapUnavailable) {
+		t.Fatalf("err = %v, want %v for a misconfigured service account", err, ErrLdapUnavailable)
+	}
+}
+
+func TestLdapLoginRemovesGroupRoles(t *testing.T) {
+	users := newMemoryUserRepository()
+	service, tokens := newLdapTestService(t, startLdapStub(t), users)
+	if _, err := service.Login("carol", "carolpw"); err != nil {
+		t.Fatal(err)
+	}
+	users.AddRole("carol", RoleManager)
+
+	user, err := service.Login("carol", "carolpw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ContainsRole(user.Roles, RoleManager) || !ContainsRole(user.Roles, RoleModerator) {
+		t.Fatalf("roles = %v, want %s removed", user.Roles, RoleManager)
+	}
+	if len(tokens.revoked) != 1 || tokens.revoked[0] != "carol" {
+		t.Fatalf("revoked sessions = %v, want carol after a role removal", tokens.revoked)
+	}
+}
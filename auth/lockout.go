@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"errors"
+	"gin-auth/persist"
+	"strings"
+	"time"
+)
+
+const userAttemptKeyPrefix = "user:"
+const ipAttemptKeyPrefix = "ip:"
+
+var ErrLoginLocked = errors.New("too many failed login attempts, try again later")
+
+type LockoutConfig struct {
+	MaxUserFailures int
+	MaxIpFailures   int
+	LockoutDuration time.Duration
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	FailureWindow   time.Duration
+}
+
+func DefaultLockoutConfig() *LockoutConfig {
+	return &LockoutConfig{
+		MaxUserFailures: 5,
+		MaxIpFailures:   20,
+		LockoutDuration: time.Minute * 15,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second * 30,
+		FailureWindow:   time.Hour,
+	}
+}
+
+type LoginGuard interface {
+	Check(username, ip string) (time.Duration, error)
+	RegisterFailure(username, ip string) error
+	RegisterSuccess(username, ip string) error
+	Release(username, ip string) error
+	UnlockUser(username string) error
+	UnlockIp(ip string) error
+}
+
+type DefaultLoginGuard struct {
+	attemptRepo persist.LoginAttemptRepository
+	config      *LockoutConfig
+}
+
+func (g *DefaultLoginGuard) Check(username, ip string) (time.Duration, error) {
+	var retryAfter time.Duration
+	now := time.Now()
+	for _, key := range attemptKeys(username, ip) {
+		attempt, err := g.attemptRepo.Find(key)
+		if err != nil {
+			return 0, err
+		}
+		if wait := g.nextAllowedAttempt(attempt).Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, ErrLoginLocked
+	}
+	return g.reserve(attemptKeys(username, ip), now)
+}
+
+func (g *DefaultLoginGuard) RegisterFailure(username, ip string) error {
+	now := time.Now()
+	for _, key := range attemptKeys(username, ip) {
+		attempt, err := g.attemptRepo.RecordFailure(key, now)
+		if err != nil {
+			return err
+		}
+		if attempt.Failures >= g.maxFailures(key) {
+			err = g.attemptRepo.Lock(key, now.Add(g.config.LockoutDuration))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *DefaultLoginGuard) RegisterSuccess(username, ip string) error {
+	err := g.attemptRepo.Delete(userAttemptKeyPrefix + username)
+	if err != nil {
+		return err
+	}
+	return g.attemptRepo.Decrement(ipAttemptKeyPrefix + ip)
+}
+
+func (g *DefaultLoginGuard) Release(username, ip string) error {
+	return g.release(attemptKeys(username, ip))
+}
+
+func (g *DefaultLoginGuard) UnlockUser(username string) error {
+	return g.attemptRepo.Delete(userAttemptKeyPrefix + username)
+}
+
+func (g *DefaultLoginGuard) UnlockIp(ip string) error {
+	return g.attemptRepo.Delete(ipAttemptKeyPrefix + ip)
+}
+
+func (g *DefaultLoginGuard) reserve(keys []string, now time.Time) (time.Duration, error) {
+	for i, key := range keys {
+		attempt, err := g.attemptRepo.Increment(key, now.Add(-g.config.FailureWindow))
+		if err != nil {
+			return 0, err
+		}
+		retryAfter := attempt.LockedUntil.Sub(now)
+		if attempt.Failures > g.maxFailures(key) && retryAfter < g.config.BaseDelay {
+			retryAfter = g.config.BaseDelay
+		}
+		if retryAfter > 0 {
+			err = g.release(keys[:i+1])
+			if err != nil {
+				return 0, err
+			}
+			return retryAfter, ErrLoginLocked
+		}
+	}
+	return 0, nil
+}
+
+func (g *DefaultLoginGuard) release(keys []string) error {
+	for _, key := range keys {
+		err := g.attemptRepo.Decrement(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *DefaultLoginGuard) nextAllowedAttempt(attempt *persist.LoginAttempt) time.Time {
+	if attempt.LockedUntil.After(attempt.LastFailure) {
+		return attempt.LockedUntil
+	}
+	if attempt.Failures == 0 {
+		return time.Time{}
+	}
+	delay := g.config.BaseDelay
+	for i := 1; i < attempt.Failures && delay < g.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.config.MaxDelay {
+		delay = g.config.MaxDelay
+	}
+	return attempt.LastFailure.Add(delay)
+}
+
+func (g *DefaultLoginGuard) maxFailures(key string) int {
+	if strings.HasPrefix(key, ipAttemptKeyPrefix) {
+		return g.config.MaxIpFailures
+	}
+	return g.config.MaxUserFailures
+}
+
+func attemptKeys(username, ip string) []string {
+	return []string{userAttemptKeyPrefix + username, ipAttemptKeyPrefix + ip}
+}
+
+func NewDefaultLoginGuard(attemptRepo persist.LoginAttemptRepository, config *LockoutConfig) LoginGuard {
+	return &DefaultLoginGuard{
+		attemptRepo: attemptRepo,
+		config:      config,
+	}
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"gin-auth/persist"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryLoginAttemptRepository struct {
+	mu       sync.Mutex
+	attempts map[string]*persist.LoginAttempt
+}
+
+func newMemoryLoginAttemptRepository() *memoryLoginAttemptRepository {
+	return &memoryLoginAttemptRepository{attempts: map[string]*persist.LoginAttempt{}}
+}
+
+func (r *memoryLoginAttemptRepository) Find(key string) (*persist.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return &persist.LoginAttempt{Key: key}, nil
+	}
+	copied := *attempt
+	return &copied, nil
+}
+
+func (r *memoryLoginAttemptRepository) Increment(key string, windowStart time.Time) (*persist.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempt, ok := r.attempts[key]
+	switch {
+	case !ok:
+		attempt = &persist.LoginAttempt{Key: key, Failures: 1}
+		r.attempts[key] = attempt
+	case attempt.UpdatedAt.Before(windowStart):
+		attempt.Failures = 1
+	default:
+		attempt.Failures++
+	}
+	attempt.UpdatedAt = time.Now()
+	copied := *attempt
+	return &copied, nil
+}
+
+func (r *memoryLoginAttemptRepository) Decrement(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if attempt, ok := r.attempts[key]; ok && attempt.Failures > 0 {
+		attempt.Failures--
+	}
+	return nil
+}
+
+func (r *memoryLoginAttemptRepository) RecordFailure(key string, at time.Time) (*persist.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return &persist.LoginAttempt{Key: key}, nil
+	}
+	attempt.LastFailure = at
+	attempt.UpdatedAt = at
+	copied := *attempt
+	return &copied, nil
+}
+
+func (r *memoryLoginAttemptRepository) Lock(key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if attempt, ok := r.attempts[key]; ok {
+		attempt.Failures = 0
+		attempt.LockedUntil = until
+	}
+	return nil
+}
+
+func (r *memoryLoginAttemptRepository) Delete(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, key)
+	return nil
+}
+
+func TestLoginGuardAccounting(t *testing.T) {
+	cases := []struct {
+		name         string
+		steps        []string
+		userFailures int
+		ipFailures   int
+	}{
+		{"released attempt", []string{"check", "release"}, 0, 0},
+		{"failed attempt", []string{"check", "failure"}, 1, 1},
+		{"successful attempt", []string{"check", "failure", "check", "success"}, 0, 1},
+		{"in flight attempts", []string{"check", "check", "check", "check locked"}, 3, 3},
+		{"released attempts free slots", []string{"check", "check", "check", "release", "check"}, 3, 3},
+		{"locked after max failures", []string{
+			"check", "failure", "check", "failure", "check", "failure", "check locked",
+		}, 0, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			repo := newMemoryLoginAttemptRepository()
+			config := DefaultLockoutConfig()
+			config.MaxUserFailures = 3
+			config.BaseDelay = time.Nanosecond
+			config.MaxDelay = time.Nanosecond
+			guard := NewDefaultLoginGuard(repo, config)
+
+			for i, step := range c.steps {
+				var err error
+				switch step {
+				case "check", "check locked":
+					_, err = guard.Check("alice", "10.0.0.1")
+					if locked := err == ErrLoginLocked; locked != (step == "check locked") {
+						t.Fatalf("step %d %s: err = %v", i, step, err)
+					}
+					err = nil
+				case "failure":
+					err = guard.RegisterFailure("alice", "10.0.0.1")
+				case "success":
+					err = guard.RegisterSuccess("alice", "10.0.0.1")
+				case "release":
+					err = guard.Release("alice", "10.0.0.1")
+				}
+				if err != nil {
+					t.Fatalf("step %d %s: %v", i, step, err)
+				}
+			}
+			user, _ := repo.Find(userAttemptKeyPrefix + "alice")
+			ip, _ := repo.Find(ipAttemptKeyPrefix + "10.0.0.1")
+			if user.Failures != c.userFailures || ip.Failures != c.ipFailures {
+				t.Fatalf("failures = user %d, ip %d, want user %d, ip %d",
+					user.Failures, ip.Failures, c.userFailures, c.ipFailures)
+			}
+		})
+	}
+}
+
+func TestLoginGuardProgressiveDelay(t *testing.T) {
+	guard := NewDefaultLoginGuard(newMemoryLoginAttemptRepository(), DefaultLockoutConfig()).(*DefaultLoginGuard)
+	lastFailure := time.Now()
+	cases := []struct {
+		failures    int
+		lockedUntil time.Time
+		want        time.Duration
+	}{
+		{1, time.Time{}, time.Second},
+		{2, time.Time{}, time.Second * 2},
+		{3, time.Time{}, time.Second * 4},
+		{5, time.Time{}, time.Second * 16},
+		{6, time.Time{}, time.Second * 30},
+		{50, time.Time{}, time.Second * 30},
+		{0, lastFailure.Add(time.Minute * 15), time.Minute * 15},
+	}
+	for _, c := range cases {
+		attempt := &persist.LoginAttempt{Failures: c.failures, LastFailure: lastFailure, LockedUntil: c.lockedUntil}
+		if got := guard.nextAllowedAttempt(attempt).Sub(lastFailure); got != c.want {
+			t.Errorf("delay after %d failures = %v, want %v", c.failures, got, c.want)
+		}
+	}
+	if next := guard.nextAllowedAttempt(&persist.LoginAttempt{}); !next.IsZero() {
+		t.Errorf("next attempt without failures = %v, want no delay", next)
+	}
+}
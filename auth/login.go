@@ -1,27 +1,99 @@
 package auth
 
-import "gin-auth/persist"
+import (
+	"errors"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+const dummyPasswordSize = 32
+
+var ErrInvalidCredentials = errors.New("incorrect credentials")
 
 type LoginService interface {
-	Login(username, password string) (*persist.User, bool)
+	Login(username, password string) (*persist.User, error)
 }
 
 type DefaultLoginService struct {
 	userRepo    persist.UserRepository
 	passEncoder PasswordEncoder
+	dummyHash   string
 }
 
-func (s *DefaultLoginService) Login(username, password string) (*persist.User, bool) {
+func (s *DefaultLoginService) Login(username, password string) (*persist.User, error) {
 	user, err := s.userRepo.FindByUsername(username)
 	if err != nil || user == nil {
-		return user, false
+		s.passEncoder.Compare(s.dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if !s.passEncoder.Compare(user.Password, password) {
+		return nil, ErrInvalidCredentials
+	}
+	if s.passEncoder.NeedsRehash(user.Password) {
+		go s.rehash(user.Username, user.Password, password)
+	}
+	return user, nil
+}
+
+func (s *DefaultLoginService) rehash(username, oldHash, password string) {
+	hash, err := s.passEncoder.Encode(password)
+	if err != nil {
+		log.Errorf("Cannot rehash the password of %s: %v", username, err)
+		return
+	}
+	_, err = s.userRepo.UpdatePasswordIfMatch(username, oldHash, hash)
+	if err != nil {
+		log.Errorf("Cannot store the rehashed password of %s: %v", username, err)
+	}
+}
+
+type ChainedLoginService struct {
+	delegates []LoginService
+}
+
+func (s *ChainedLoginService) Login(username, password string) (*persist.User, error) {
+	failure := ErrInvalidCredentials
+	for _, delegate := range s.delegates {
+		user, err := delegate.Login(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if err != ErrInvalidCredentials {
+			failure = err
+		}
+	}
+	return nil, failure
+}
+
+func NewChainedLoginService(delegates ...LoginService) LoginService {
+	return &ChainedLoginService{
+		delegates: delegates,
 	}
-	return user, s.passEncoder.Compare(user.Password, password)
 }
 
 func NewDefaultLoginService(userRepo persist.UserRepository, passEncoder PasswordEncoder) LoginService {
 	return &DefaultLoginService{
 		userRepo:    userRepo,
 		passEncoder: passEncoder,
+		dummyHash:   newDummyHash(passEncoder),
+	}
+}
+
+func newDummyHash(passEncoder PasswordEncoder) string {
+	dummyHash, err := newRandomPasswordHash(passEncoder)
+	if err != nil {
+		panic(err)
+	}
+	return dummyHash
+}
+
+func newRandomPasswordHash(passEncoder PasswordEncoder) (string, error) {
+	password, err := util.GenerateRandomToken(dummyPasswordSize)
+	if err != nil {
+		return "", err
 	}
+	return passEncoder.Encode(password)
 }
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"errors"
+	"gin-auth/persist"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeHashCost = time.Millisecond * 20
+const timingSamples = 15
+
+type slowPasswordEncoder struct {
+	version string
+}
+
+func (e *slowPasswordEncoder) Encode(password string) (string, error) {
+	time.Sleep(fakeHashCost)
+	return e.version + ":" + password, nil
+}
+
+func (e *slowPasswordEncoder) Compare(hash, raw string) bool {
+	time.Sleep(fakeHashCost)
+	return strings.SplitN(hash, ":", 2)[1] == raw
+}
+
+func (e *slowPasswordEncoder) NeedsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, e.version+":")
+}
+
+type memoryUserRepository struct {
+	mu      sync.Mutex
+	users   map[string]*persist.User
+	frozen  bool
+	updated chan string
+}
+
+func newMemoryUserRepository(users ...*persist.User) *memoryUserRepository {
+	repo := &memoryUserRepository{users: map[string]*persist.User{}, updated: make(chan string, 16)}
+	for _, user := range users {
+		repo.users[user.Username] = user
+	}
+	return repo
+}
+
+func (r *memoryUserRepository) Save(user *persist.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[user.Username] = user
+	return nil
+}
+
+func (r *memoryUserRepository) Update(user *persist.User) error {
+	r.mu.Lock()
+	stored, ok := r.users[user.Username]
+	if ok && !r.frozen {
+		stored.Password = user.Password
+	}
+	r.mu.Unlock()
+	if !ok {
+		return errors.New("record not found")
+	}
+	select {
+	case r.updated <- user.Username:
+	default:
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) UpdatePasswordIfMatch(username, oldHash, newHash string) (bool, error) {
+	r.mu.Lock()
+	stored, ok := r.users[username]
+	matched := ok && stored.Password == oldHash
+	if matched && !r.frozen {
+		stored.Password = newHash
+	}
+	r.mu.Unlock()
+	if !matched {
+		return false, nil
+	}
+	select {
+	case r.updated <- username:
+	default:
+	}
+	return true, nil
+}
+
+func (r *memoryUserRepository) FindByUsername(username string) (*persist.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[username]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (r *memoryUserRepository) FindByEmail(email string) (*persist.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email != "" && user.Email == email {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *memoryUserRepository) MarkEmailVerified(username string) error {
+	return nil
+}
+
+func (r *memoryUserRepository) AddRole(username, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[username]
+	if !ok {
+		return errors.New("record not found")
+	}
+	user.Roles = append(user.Roles, persist.Role{Name: role})
+	return nil
+}
+
+func (r *memoryUserRepository) RemoveRole(username, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[username]
+	if !ok {
+		return errors.New("record not found")
+	}
+	var roles []persist.Role
+	for _, existing := range user.Roles {
+		if existing.Name != role {
+			roles = append(roles, existing)
+		}
+	}
+	user.Roles = roles
+	return nil
+}
+
+func medianLoginDuration(service LoginService, username, password string) time.Duration {
+	durations := make([]time.Duration, timingSamples)
+	for i := range durations {
+		start := time.Now()
+		service.Login(username, password)
+		durations[i] = time.Since(start)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[timingSamples/2]
+}
+
+func TestDefaultLoginServiceTiming(t *testing.T) {
+	repo := newMemoryUserRepository(
+		&persist.User{Username: "current", Password: "v2:secret"},
+		&persist.User{Username: "outdated", Password: "v1:secret"},
+	)
+	repo.frozen = true
+	service := NewDefaultLoginService(repo, &slowPasswordEncoder{version: "v2"})
+
+	cases := map[string]time.Duration{
+		"unknown user":       medianLoginDuration(service, "nobody", "secret"),
+		"wrong password":     medianLoginDuration(service, "current", "wrong"),
+		"correct password":   medianLoginDuration(service, "current", "secret"),
+		"rehashed on login":  medianLoginDuration(service, "outdated", "secret"),
+		"outdated and wrong": medianLoginDuration(service, "outdated", "wrong"),
+	}
+	var fastest, slowest time.Duration
+	for name, duration := range cases {
+		t.Logf("%s: %v", name, duration)
+		if fastest == 0 || duration < fastest {
+			fastest = duration
+		}
+		if duration > slowest {
+			slowest = duration
+		}
+	}
+	if slowest-fastest > fakeHashCost/2 {
+		t.Fatalf("login timing differs by %v across outcomes, want less than %v", slowest-fastest, fakeHashCost/2)
+	}
+}
+
+func TestDefaultLoginServiceRehashesOutdatedHash(t *testing.T) {
+	repo := newMemoryUserRepository(&persist.User{Username: "outdated", Password: "v1:secret"})
+	service := NewDefaultLoginService(repo, &slowPasswordEncoder{version: "v2"})
+
+	user, err := service.Login("outdated", "secret")
+	if err != nil || user.Username != "outdated" {
+		t.Fatalf("login failed for valid credentials: %v", err)
+	}
+	select {
+	case <-repo.updated:
+	case <-time.After(time.Second):
+		t.Fatalf("outdated hash was not rehashed")
+	}
+	stored, _ := repo.FindByUsername("outdated")
+	if stored.Password != "v2:secret" {
+		t.Fatalf("stored hash = %q, want v2 hash", stored.Password)
+	}
+	if _, err = service.Login("outdated", "secret"); err != nil {
+		t.Fatalf("login failed after rehash: %v", err)
+	}
+}
+
+func TestDefaultLoginServiceRehashKeepsChangedPassword(t *testing.T) {
+	repo := newMemoryUserRepository(&persist.User{Username: "outdated", Password: "v1:secret"})
+	service := NewDefaultLoginService(repo, &slowPasswordEncoder{version: "v2"}).(*DefaultLoginService)
+
+	repo.Update(&persist.User{Username: "outdated", Password: "v2:changed"})
+	service.rehash("outdated", "v1:secret", "secret")
+
+	stored, _ := repo.FindByUsername("outdated")
+	if stored.Password != "v2:changed" {
+		t.Fatalf("stored hash = %q, a rehash overwrote the changed password", stored.Password)
+	}
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"errors"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"strings"
+	"time"
+)
+
+const mfaChallengeSize = 32
+const recoveryCodeSize = 10
+
+var ErrMfaAlreadyEnabled = errors.New("mfa already enabled")
+var ErrMfaNotEnrolled = errors.New("mfa not enrolled")
+var ErrInvalidMfaCode = errors.New("invalid mfa code")
+var ErrInvalidMfaChallenge = errors.New("invalid or expired mfa token")
+
+type MfaConfig struct {
+	Issuer            string
+	ChallengeTTL      time.Duration
+	MaxAttempts       int
+	RecoveryCodeCount int
+	Skew              int64
+	RequiredRoles     []string
+}
+
+func DefaultMfaConfig() *MfaConfig {
+	return &MfaConfig{
+		Issuer:            "gin-auth",
+		ChallengeTTL:      time.Minute * 5,
+		MaxAttempts:       5,
+		RecoveryCodeCount: 10,
+		Skew:              1,
+	}
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type MfaPendingToken struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type MfaService interface {
+	Enroll(username string) (*TotpEnrollment, error)
+	Confirm(username, code string) ([]string, error)
+	Disable(username, code string) error
+	RegenerateRecoveryCodes(username, code string) ([]string, error)
+	Enabled(username string) (bool, error)
+	Verify(username, code string) error
+	Challenge(user *persist.User) (*MfaPendingToken, error)
+	ChallengeOwner(token string) (string, error)
+	VerifyChallenge(token, code string) (*persist.User, error)
+	Restrict(user *persist.User) (*persist.User, bool, error)
+}
+
+type DefaultMfaService struct {
+	userRepo      persist.UserRepository
+	totpRepo      persist.TotpCredentialRepository
+	recoveryRepo  persist.RecoveryCodeRepository
+	challengeRepo persist.MfaChallengeRepository
+	config        *MfaConfig
+}
+
+func (s *DefaultMfaService) Enroll(username string) (*TotpEnrollment, error) {
+	enabled, err := s.Enabled(username)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMfaAlreadyEnabled
+	}
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = s.totpRepo.Save(&persist.TotpCredential{
+		OwnerRefer: username,
+		Secret:     secret,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TotpEnrollment{
+		Secret: secret,
+		Uri:    totpUri(s.config.Issuer, username, secret),
+	}, nil
+}
+
+func (s *DefaultMfaService) Confirm(username, code string) ([]string, error) {
+	credential, err := s.totpRepo.FindByOwnerUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if credential.Secret == "" {
+		return nil, ErrMfaNotEnrolled
+	}
+	if credential.Confirmed {
+		return nil, ErrMfaAlreadyEnabled
+	}
+	err = s.verifyTotp(credential, code)
+	if err != nil {
+		return nil, err
+	}
+	err = s.totpRepo.Confirm(username)
+	if err != nil {
+		return nil, err
+	}
+	return s.generateRecoveryCodes(username)
+}
+
+func (s *DefaultMfaService) Disable(username, code string) error {
+	err := s.verifyCode(username, code)
+	if err != nil {
+		return err
+	}
+	err = s.recoveryRepo.DeleteAllByOwnerUsername(username)
+	if err != nil {
+		return err
+	}
+	return s.totpRepo.DeleteByOwnerUsername(username)
+}
+
+func (s *DefaultMfaService) RegenerateRecoveryCodes(username, code string) ([]string, error) {
+	err := s.verifyCode(username, code)
+	if err != nil {
+		return nil, err
+	}
+	return s.generateRecoveryCodes(username)
+}
+
+func (s *DefaultMfaService) Enabled(username string) (bool, error) {
+	credential, err := s.totpRepo.FindByOwnerUsername(username)
+	if err != nil {
+		return false, err
+	}
+	return credential.Confirmed, nil
+}
+
+func (s *DefaultMfaService) Verify(username, code string) error {
+	return s.verifyCode(username, code)
+}
+
+func (s *DefaultMfaService) Challenge(user *persist.User) (*MfaPendingToken, error) {
+	token, err := util.GenerateRandomToken(mfaChallengeSize)
+	if err != nil {
+		return nil, err
+	}
+	err = s.challengeRepo.Save(&persist.MfaChallenge{
+		TokenHash:  util.HashToken(token),
+		OwnerRefer: user.Username,
+		ExpiresAt:  time.Now().Add(s.config.ChallengeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MfaPendingToken{
+		MfaRequired: true,
+		MfaToken:    token,
+		ExpiresIn:   int64(s.config.ChallengeTTL.Seconds()),
+	}, nil
+}
+
+func (s *DefaultMfaService) ChallengeOwner(token string) (string, error) {
+	challenge, err := s.findChallenge(token)
+	if err != nil {
+		return "", err
+	}
+	return challenge.OwnerRefer, nil
+}
+
+func (s *DefaultMfaService) VerifyChallenge(token, code string) (*persist.User, error) {
+	challenge, err := s.findChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	err = s.verifyCode(challenge.OwnerRefer, code)
+	if err == ErrInvalidMfaCode {
+		incrementErr := s.challengeRepo.IncrementAttempts(challenge.ID)
+		if incrementErr != nil {
+			return nil, incrementErr
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	marked, err := s.challengeRepo.MarkUsed(challenge.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ErrInvalidMfaChallenge
+	}
+	user, err := s.userRepo.FindByUsername(challenge.OwnerRefer)
+	if err != nil {
+		return nil, ErrInvalidMfaChallenge
+	}
+	return user, nil
+}
+
+func (s *DefaultMfaService) Restrict(user *persist.User) (*persist.User, bool, error) {
+	if !s.mfaRequired(user) {
+		return user, false, nil
+	}
+	enabled, err := s.Enabled(user.Username)
+	if err != nil {
+		return nil, false, err
+	}
+	if enabled {
+		return user, false, nil
+	}
+	restricted := *user
+	restricted.Roles = nil
+	for _, role := range user.Roles {
+		if !containsString(s.config.RequiredRoles, role.Name) {
+			restricted.Roles = append(restricted.Roles, role)
+		}
+	}
+	return &restricted, true, nil
+}
+
+func (s *DefaultMfaService) mfaRequired(user *persist.User) bool {
+	for _, role := range user.Roles {
+		if containsString(s.config.RequiredRoles, role.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DefaultMfaService) findChallenge(token string) (*persist.MfaChallenge, error) {
+	challenge, err := s.challengeRepo.FindByHash(util.HashToken(token))
+	if err != nil || challenge.Used || time.Now().After(challenge.ExpiresAt) ||
+		challenge.Attempts >= s.config.MaxAttempts {
+		return nil, ErrInvalidMfaChallenge
+	}
+	return challenge, nil
+}
+
+func (s *DefaultMfaService) verifyCode(username, code string) error {
+	credential, err := s.totpRepo.FindByOwnerUsername(username)
+	if err != nil {
+		return err
+	}
+	if !credential.Confirmed {
+		return ErrMfaNotEnrolled
+	}
+	code = normalizeMfaCode(code)
+	if len(code) == totpDigits {
+		return s.verifyTotp(credential, code)
+	}
+	used, err := s.recoveryRepo.MarkUsed(username, util.HashToken(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMfaCode
+	}
+	return nil
+}
+
+func (s *DefaultMfaService) verifyTotp(credential *persist.TotpCredential, code string) error {
+	step, ok := matchTotpCode(credential.Secret, normalizeMfaCode(code), time.Now(), s.config.Skew)
+	if !ok {
+		return ErrInvalidMfaCode
+	}
+	updated, err := s.totpRepo.UpdateLastStep(credential.OwnerRefer, step)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrInvalidMfaCode
+	}
+	return nil
+}
+
+func (s *DefaultMfaService) generateRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, s.config.RecoveryCodeCount)
+	stored := make([]persist.RecoveryCode, s.config.RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		stored[i] = persist.RecoveryCode{
+			CodeHash:   util.HashToken(normalizeMfaCode(code)),
+			OwnerRefer: username,
+		}
+	}
+	err := s.recoveryRepo.ReplaceAll(username, stored)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func generateRecoveryCode() (string, error) {
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(secret[:recoveryCodeSize])
+	return code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:], nil
+}
+
+func normalizeMfaCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func NewDefaultMfaService(userRepo persist.UserRepository, totpRepo persist.TotpCredentialRepository,
+	recoveryRepo persist.RecoveryCodeRepository, challengeRepo persist.MfaChallengeRepository,
+	config *MfaConfig) MfaService {
+	return &DefaultMfaService{
+		userRepo:      userRepo,
+		totpRepo:      totpRepo,
+		recoveryRepo:  recoveryRepo,
+		challengeRepo: challengeRepo,
+		config:        config,
+	}
+}
@@ -0,0 +1,79 @@
+package oauth
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const (
+	ErrorInvalidRequest          = "invalid_request"
+	ErrorInvalidClient           = "invalid_client"
+	ErrorInvalidGrant            = "invalid_grant"
+	ErrorUnauthorizedClient      = "unauthorized_client"
+	ErrorUnsupportedGrantType    = "unsupported_grant_type"
+	ErrorUnsupportedResponseType = "unsupported_response_type"
+	ErrorInvalidScope            = "invalid_scope"
+	ErrorAccessDenied            = "access_denied"
+	ErrorLoginRequired           = "login_required"
+	ErrorInvalidToken            = "invalid_token"
+	ErrorInsufficientScope       = "insufficient_scope"
+)
+
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	Status      int    `json:"-"`
+	redirect    bool
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func (e *Error) Redirectable() bool {
+	return e.redirect
+}
+
+func newError(code, description string) *Error {
+	status := http.StatusBadRequest
+	if code == ErrorInvalidClient || code == ErrorInvalidToken {
+		status = http.StatusUnauthorized
+	} else if code == ErrorInsufficientScope {
+		status = http.StatusForbidden
+	}
+	return &Error{Code: code, Description: description, Status: status}
+}
+
+func newRedirectError(code, description string) *Error {
+	err := newError(code, description)
+	err.redirect = true
+	return err
+}
+
+func ErrorRedirectUri(request *AuthorizationRequest, err *Error) string {
+	query := url.Values{}
+	query.Set("error", err.Code)
+	if err.Description != "" {
+		query.Set("error_description", err.Description)
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	return appendQuery(request.RedirectUri, query)
+}
+
+func appendQuery(uri string, query url.Values) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	values := parsed.Query()
+	for name, value := range query {
+		values[name] = value
+	}
+	parsed.RawQuery = values.Encode()
+	return parsed.String()
+}
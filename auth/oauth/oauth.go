@@ -0,0 +1,424 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gin-auth/auth"
+	"gin-auth/auth/jwt"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+const ResponseTypeCode = "code"
+const CodeChallengeMethodS256 = "S256"
+
+const clientIdSize = 16
+const clientSecretSize = 32
+const authorizationCodeSize = 32
+const minCodeVerifierLength = 43
+const maxCodeVerifierLength = 128
+
+var ErrInvalidRedirectUri = errors.New("redirect uri must be absolute, without fragment, and use https unless it targets a loopback host")
+
+type Config struct {
+	Issuer            string
+	CodeTTL           time.Duration
+	ScopeRoles        auth.ScopeRoleMapping
+	IdTokenHintMaxAge time.Duration
+}
+
+func DefaultConfig(issuer string) *Config {
+	return &Config{
+		Issuer:            issuer,
+		CodeTTL:           time.Minute,
+		ScopeRoles:        auth.DefaultScopeRoleMapping(),
+		IdTokenHintMaxAge: time.Hour * 24,
+	}
+}
+
+type ClientRegistration struct {
+	Name                   string   `json:"name"`
+	RedirectUris           []string `json:"redirect_uris"`
+	PostLogoutRedirectUris []string `json:"post_logout_redirect_uris"`
+	Scopes                 []string `json:"scopes"`
+	GrantTypes             []string `json:"grant_types"`
+	Public                 bool     `json:"public"`
+}
+
+type RegisteredClient struct {
+	*persist.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+type AuthorizationRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientId            string `form:"client_id"`
+	RedirectUri         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Nonce               string `form:"nonce"`
+	Prompt              string `form:"prompt"`
+}
+
+type TokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectUri  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	Scope        string `form:"scope"`
+	ClientId     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+type Service interface {
+	RegisterClient(owner string, registration *ClientRegistration) (*RegisteredClient, error)
+	FindAllClients() ([]*persist.OAuthClient, error)
+	DeleteClient(clientId string) (bool, error)
+	ValidateAuthorizationRequest(request *AuthorizationRequest) (*persist.OAuthClient, []string, error)
+	Authorize(request *AuthorizationRequest, user *persist.User) (string, error)
+	Token(request *TokenRequest) (*auth.TokenPair, error)
+	Discovery() *Discovery
+	UserInfo(claims *jwt.AppClaims) (map[string]interface{}, error)
+	ValidateEndSession(request *EndSessionRequest) (*persist.OAuthClient, error)
+	EndSession(request *EndSessionRequest) (string, error)
+}
+
+type DefaultService struct {
+	clientRepo   persist.OAuthClientRepository
+	codeRepo     persist.AuthorizationCodeRepository
+	userRepo     persist.UserRepository
+	jwtService   jwt.JwtService
+	tokenService auth.TokenService
+	config       *Config
+}
+
+func (s *DefaultService) RegisterClient(owner string, registration *ClientRegistration) (*RegisteredClient, error) {
+	if registration.Name == "" {
+		return nil, errors.New("client name is required")
+	}
+	if len(registration.GrantTypes) == 0 {
+		registration.GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	for _, grantType := range registration.GrantTypes {
+		switch grantType {
+		case GrantAuthorizationCode, GrantRefreshToken:
+		case GrantClientCredentials:
+			if registration.Public {
+				return nil, errors.New("public clients cannot use the client_credentials grant")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported grant type: %s", grantType)
+		}
+	}
+	if contains(registration.GrantTypes, GrantAuthorizationCode) && len(registration.RedirectUris) == 0 {
+		return nil, errors.New("at least one redirect uri is required")
+	}
+	for _, redirectUri := range registration.RedirectUris {
+		if !validRedirectUri(redirectUri) {
+			return nil, ErrInvalidRedirectUri
+		}
+	}
+	for _, redirectUri := range registration.PostLogoutRedirectUris {
+		if !validRedirectUri(redirectUri) {
+			return nil, ErrInvalidRedirectUri
+		}
+	}
+	for _, scope := range registration.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \"\\") {
+			return nil, fmt.Errorf("invalid scope: %q", scope)
+		}
+	}
+	clientId, err := util.GenerateRandomToken(clientIdSize)
+	if err != nil {
+		return nil, err
+	}
+	client := &persist.OAuthClient{
+		ClientId:               clientId,
+		Name:                   registration.Name,
+		RedirectUris:           strings.Join(registration.RedirectUris, " "),
+		PostLogoutRedirectUris: strings.Join(registration.PostLogoutRedirectUris, " "),
+		Scopes:                 strings.Join(registration.Scopes, " "),
+		GrantTypes:             strings.Join(registration.GrantTypes, " "),
+		OwnerRefer:             owner,
+	}
+	var secret string
+	if !registration.Public {
+		secret, err = util.GenerateRandomToken(clientSecretSize)
+		if err != nil {
+			return nil, err
+		}
+		client.SecretHash = util.HashToken(secret)
+	}
+	err = s.clientRepo.Save(client)
+	if err != nil {
+		return nil, err
+	}
+	return &RegisteredClient{OAuthClient: client, ClientSecret: secret}, nil
+}
+
+func (s *DefaultService) FindAllClients() ([]*persist.OAuthClient, error) {
+	return s.clientRepo.FindAll()
+}
+
+func (s *DefaultService) DeleteClient(clientId string) (bool, error) {
+	return s.clientRepo.Delete(clientId)
+}
+
+func (s *DefaultService) ValidateAuthorizationRequest(request *AuthorizationRequest) (*persist.OAuthClient, []string, error) {
+	client, err := s.clientRepo.FindByClientId(request.ClientId)
+	if err != nil {
+		return nil, nil, newError(ErrorInvalidClient, "unknown client")
+	}
+	if !contains(strings.Fields(client.RedirectUris), request.RedirectUri) {
+		return nil, nil, newError(ErrorInvalidRequest, "redirect_uri is not registered for this client")
+	}
+	if request.ResponseType != ResponseTypeCode {
+		return nil, nil, newRedirectError(ErrorUnsupportedResponseType, "only the code response type is supported")
+	}
+	if !contains(strings.Fields(client.GrantTypes), GrantAuthorizationCode) {
+		return nil, nil, newRedirectError(ErrorUnauthorizedClient, "client may not use the authorization_code grant")
+	}
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != CodeChallengeMethodS256 {
+		return nil, nil, newRedirectError(ErrorInvalidRequest, "code_challenge with the S256 method is required")
+	}
+	scopes, err := s.requestedScopes(client, request.Scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if contains(strings.Fields(request.Prompt), promptNone) {
+		return nil, nil, newRedirectError(ErrorLoginRequired, "interactive authentication is always required")
+	}
+	return client, scopes, nil
+}
+
+func (s *DefaultService) Authorize(request *AuthorizationRequest, user *persist.User) (string, error) {
+	client, scopes, err := s.ValidateAuthorizationRequest(request)
+	if err != nil {
+		return "", err
+	}
+	code, err := util.GenerateRandomToken(authorizationCodeSize)
+	if err != nil {
+		return "", err
+	}
+	err = s.codeRepo.Save(&persist.AuthorizationCode{
+		CodeHash:            util.HashToken(code),
+		ClientId:            client.ClientId,
+		OwnerRefer:          user.Username,
+		RedirectUri:         request.RedirectUri,
+		Scopes:              strings.Join(s.grantableScopes(user, scopes), " "),
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(s.config.CodeTTL),
+		Nonce:               request.Nonce,
+		AuthTime:            time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("code", code)
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	return appendQuery(request.RedirectUri, query), nil
+}
+
+func (s *DefaultService) Token(request *TokenRequest) (*auth.TokenPair, error) {
+	client, err := s.authenticateClient(request)
+	if err != nil {
+		return nil, err
+	}
+	switch request.GrantType {
+	case GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials:
+		if !contains(strings.Fields(client.GrantTypes), request.GrantType) {
+			return nil, newError(ErrorUnauthorizedClient, "client may not use the "+request.GrantType+" grant")
+		}
+	default:
+		return nil, newError(ErrorUnsupportedGrantType, "")
+	}
+	switch request.GrantType {
+	case GrantAuthorizationCode:
+		return s.exchangeCode(client, request)
+	case GrantRefreshToken:
+		return s.refresh(client, request)
+	default:
+		return s.clientCredentials(client, request)
+	}
+}
+
+func (s *DefaultService) exchangeCode(client *persist.OAuthClient, request *TokenRequest) (*auth.TokenPair, error) {
+	code, err := s.codeRepo.FindByHash(util.HashToken(request.Code))
+	if err != nil || code.Used || time.Now().After(code.ExpiresAt) || code.ClientId != client.ClientId {
+		return nil, newError(ErrorInvalidGrant, "invalid or expired authorization code")
+	}
+	if code.RedirectUri != request.RedirectUri {
+		return nil, newError(ErrorInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, request.CodeVerifier) {
+		return nil, newError(ErrorInvalidGrant, "code_verifier does not match the code challenge")
+	}
+	marked, err := s.codeRepo.MarkUsed(code.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, newError(ErrorInvalidGrant, "invalid or expired authorization code")
+	}
+	user, err := s.userRepo.FindByUsername(code.OwnerRefer)
+	if err != nil {
+		return nil, newError(ErrorInvalidGrant, "resource owner no longer exists")
+	}
+	scopes := strings.Fields(code.Scopes)
+	pair, err := s.tokenService.IssueForClient(user, &auth.ClientGrant{
+		ClientId: client.ClientId,
+		Scopes:   scopes,
+	})
+	if err == auth.ErrEmailNotVerified {
+		return nil, newError(ErrorInvalidGrant, err.Error())
+	}
+	if err != nil || !contains(scopes, ScopeOpenId) {
+		return pair, err
+	}
+	pair.IdToken, err = s.idToken(user, code)
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (s *DefaultService) refresh(client *persist.OAuthClient, request *TokenRequest) (*auth.TokenPair, error) {
+	pair, err := s.tokenService.RefreshForClient(request.RefreshToken, client.ClientId)
+	if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+		return nil, newError(ErrorInvalidGrant, err.Error())
+	}
+	return pair, err
+}
+
+func (s *DefaultService) clientCredentials(client *persist.OAuthClient, request *TokenRequest) (*auth.TokenPair, error) {
+	if client.SecretHash == "" {
+		return nil, newError(ErrorUnauthorizedClient, "public clients cannot use the client_credentials grant")
+	}
+	scopes, err := s.requestedScopes(client, request.Scope)
+	if err != nil {
+		return nil, newError(ErrorInvalidScope, "")
+	}
+	grant := &auth.ClientGrant{ClientId: client.ClientId, Scopes: scopes}
+	options := append(grant.TokenOptions(), jwt.WithSubject(client.ClientId))
+	accessToken, err := s.jwtService.GenerateToken(&persist.User{Roles: s.config.ScopeRoles.Roles(scopes)}, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TokenPair{
+		AccessToken: accessToken,
+		TokenType:   auth.TokenTypeBearer,
+		ExpiresIn:   int64(s.jwtService.TokenTTL().Seconds()),
+		Scope:       grant.Scope(),
+	}, nil
+}
+
+func (s *DefaultService) authenticateClient(request *TokenRequest) (*persist.OAuthClient, error) {
+	client, err := s.clientRepo.FindByClientId(request.ClientId)
+	if err != nil {
+		return nil, newError(ErrorInvalidClient, "unknown client")
+	}
+	if client.SecretHash == "" {
+		if request.ClientSecret != "" {
+			return nil, newError(ErrorInvalidClient, "public clients must not send a secret")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(util.HashToken(request.ClientSecret))) != 1 {
+		return nil, newError(ErrorInvalidClient, "client authentication failed")
+	}
+	return client, nil
+}
+
+func (s *DefaultService) requestedScopes(client *persist.OAuthClient, scope string) ([]string, error) {
+	allowed := strings.Fields(client.Scopes)
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	for _, scope := range requested {
+		if !contains(allowed, scope) {
+			return nil, newRedirectError(ErrorInvalidScope, "scope not allowed for this client: "+scope)
+		}
+	}
+	return requested, nil
+}
+
+func (s *DefaultService) grantableScopes(user *persist.User, scopes []string) []string {
+	var grantable []string
+	for _, scope := range scopes {
+		role, mapped := s.config.ScopeRoles[scope]
+		if !mapped || auth.ContainsRole(user.Roles, role) {
+			grantable = append(grantable, scope)
+		}
+	}
+	return grantable
+}
+
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < minCodeVerifierLength || len(verifier) > maxCodeVerifierLength {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func validRedirectUri(redirectUri string) bool {
+	parsed, err := url.Parse(redirectUri)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || parsed.Host == "" {
+		return false
+	}
+	if parsed.Scheme == "https" {
+		return true
+	}
+	if parsed.Scheme != "http" {
+		return false
+	}
+	if parsed.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(parsed.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func NewDefaultService(clientRepo persist.OAuthClientRepository, codeRepo persist.AuthorizationCodeRepository,
+	userRepo persist.UserRepository, jwtService jwt.JwtService, tokenService auth.TokenService,
+	config *Config) Service {
+	return &DefaultService{
+		clientRepo:   clientRepo,
+		codeRepo:     codeRepo,
+		userRepo:     userRepo,
+		jwtService:   jwtService,
+		tokenService: tokenService,
+		config:       config,
+	}
+}
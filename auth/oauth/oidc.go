@@ -0,0 +1,185 @@
+package oauth
+
+import (
+	"gin-auth/auth"
+	"gin-auth/auth/jwt"
+	"gin-auth/persist"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+const (
+	ClaimNonce             = "nonce"
+	ClaimAuthTime          = "auth_time"
+	ClaimAuthorizedParty   = "azp"
+	ClaimPreferredUsername = "preferred_username"
+	ClaimUpdatedAt         = "updated_at"
+	ClaimEmail             = "email"
+	ClaimEmailVerified     = "email_verified"
+)
+
+const promptNone = "none"
+
+const authorizationPath = "/oauth/authorize"
+const tokenPath = "/oauth/token"
+const userInfoPath = "/userinfo"
+const jwksPath = "/.well-known/jwks.json"
+const endSessionPath = "/oauth/logout"
+
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type EndSessionRequest struct {
+	IdTokenHint           string `form:"id_token_hint"`
+	ClientId              string `form:"client_id"`
+	PostLogoutRedirectUri string `form:"post_logout_redirect_uri"`
+	State                 string `form:"state"`
+}
+
+func (s *DefaultService) Discovery() *Discovery {
+	issuer := strings.TrimSuffix(s.config.Issuer, "/")
+	scopes := []string{ScopeOpenId, ScopeProfile, ScopeEmail}
+	for scope := range s.config.ScopeRoles {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes[3:])
+	return &Discovery{
+		Issuer:                            s.config.Issuer,
+		AuthorizationEndpoint:             issuer + authorizationPath,
+		TokenEndpoint:                     issuer + tokenPath,
+		UserInfoEndpoint:                  issuer + userInfoPath,
+		JwksUri:                           issuer + jwksPath,
+		EndSessionEndpoint:                issuer + endSessionPath,
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{ResponseTypeCode},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{s.jwtService.SigningAlgorithm()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{CodeChallengeMethodS256},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", ClaimAuthTime, ClaimNonce, ClaimAuthorizedParty,
+			ClaimPreferredUsername, ClaimUpdatedAt, ClaimEmail, ClaimEmailVerified},
+	}
+}
+
+func (s *DefaultService) UserInfo(claims *jwt.AppClaims) (map[string]interface{}, error) {
+	scope, _ := claims.Custom[auth.ClaimScope].(string)
+	scopes := strings.Fields(scope)
+	if !contains(scopes, ScopeOpenId) || claims.Username == "" {
+		return nil, newError(ErrorInsufficientScope, "the access token was not granted the openid scope")
+	}
+	user, err := s.userRepo.FindByUsername(claims.Username)
+	if err != nil {
+		return nil, newError(ErrorInvalidToken, "resource owner no longer exists")
+	}
+	info := profileClaims(user, scopes)
+	info["sub"] = user.Username
+	return info, nil
+}
+
+func (s *DefaultService) ValidateEndSession(request *EndSessionRequest) (*persist.OAuthClient, error) {
+	client, _, err := s.validateEndSession(request)
+	return client, err
+}
+
+func (s *DefaultService) EndSession(request *EndSessionRequest) (string, error) {
+	client, claims, err := s.validateEndSession(request)
+	if err != nil {
+		return "", err
+	}
+	err = s.tokenService.RevokeClient(claims.Subject, client.ClientId)
+	if err != nil {
+		return "", err
+	}
+	if request.PostLogoutRedirectUri == "" {
+		return "", nil
+	}
+	query := url.Values{}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	return appendQuery(request.PostLogoutRedirectUri, query), nil
+}
+
+func (s *DefaultService) validateEndSession(request *EndSessionRequest) (*persist.OAuthClient, *jwt.AppClaims, error) {
+	if request.IdTokenHint == "" {
+		return nil, nil, newError(ErrorInvalidRequest, "id_token_hint is required")
+	}
+	claims, err := s.jwtService.VerifyIdToken(request.IdTokenHint)
+	if err != nil || len(claims.Audience) != 1 {
+		return nil, nil, newError(ErrorInvalidRequest, "invalid id_token_hint")
+	}
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > s.config.IdTokenHintMaxAge {
+		return nil, nil, newError(ErrorInvalidRequest, "id_token_hint is too old")
+	}
+	clientId := claims.Audience[0]
+	if request.ClientId != "" && request.ClientId != clientId {
+		return nil, nil, newError(ErrorInvalidRequest, "client_id does not match the id_token_hint audience")
+	}
+	client, err := s.clientRepo.FindByClientId(clientId)
+	if err != nil {
+		return nil, nil, newError(ErrorInvalidRequest, "unknown client")
+	}
+	if request.PostLogoutRedirectUri != "" &&
+		!contains(strings.Fields(client.PostLogoutRedirectUris), request.PostLogoutRedirectUri) {
+		return nil, nil, newError(ErrorInvalidRequest, "post_logout_redirect_uri is not registered for this client")
+	}
+	return client, claims, nil
+}
+
+func (s *DefaultService) idToken(user *persist.User, code *persist.AuthorizationCode) (string, error) {
+	identity := *user
+	identity.Roles = nil
+	options := []jwt.TokenOption{
+		jwt.WithAudience(code.ClientId),
+		jwt.WithClaim(jwt.ClaimTokenUse, jwt.TokenUseId),
+		jwt.WithClaim(ClaimAuthorizedParty, code.ClientId),
+		jwt.WithClaim(ClaimAuthTime, code.AuthTime.Unix()),
+	}
+	if code.Nonce != "" {
+		options = append(options, jwt.WithClaim(ClaimNonce, code.Nonce))
+	}
+	for name, value := range profileClaims(user, strings.Fields(code.Scopes)) {
+		options = append(options, jwt.WithClaim(name, value))
+	}
+	return s.jwtService.GenerateToken(&identity, options...)
+}
+
+func profileClaims(user *persist.User, scopes []string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if contains(scopes, ScopeProfile) {
+		claims[ClaimPreferredUsername] = user.Username
+		if !user.UpdatedAt.IsZero() {
+			claims[ClaimUpdatedAt] = user.UpdatedAt.Unix()
+		}
+	}
+	if contains(scopes, ScopeEmail) && user.Email != "" {
+		claims[ClaimEmail] = user.Email
+		claims[ClaimEmailVerified] = user.EmailVerified
+	}
+	return claims
+}
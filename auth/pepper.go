@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const pepperHashPrefix = "$pepper$v="
+
+var ErrUnknownPepperVersion = errors.New("current pepper version is not configured")
+
+type PepperedPasswordEncoder struct {
+	delegate       PasswordEncoder
+	peppers        map[int][]byte
+	currentVersion int
+}
+
+func (e *PepperedPasswordEncoder) Encode(password string) (string, error) {
+	pepper, ok := e.peppers[e.currentVersion]
+	if !ok {
+		return e.delegate.Encode(password)
+	}
+	hash, err := e.delegate.Encode(applyPepper(pepper, password))
+	if err != nil {
+		return "", err
+	}
+	return pepperHashPrefix + strconv.Itoa(e.currentVersion) + hash, nil
+}
+
+func (e *PepperedPasswordEncoder) Compare(hash, raw string) bool {
+	version, innerHash, peppered := splitPepperedHash(hash)
+	if !peppered {
+		return e.delegate.Compare(hash, raw)
+	}
+	pepper, ok := e.peppers[version]
+	if !ok {
+		return false
+	}
+	return e.delegate.Compare(innerHash, applyPepper(pepper, raw))
+}
+
+func (e *PepperedPasswordEncoder) NeedsRehash(hash string) bool {
+	version, innerHash, peppered := splitPepperedHash(hash)
+	_, pepperConfigured := e.peppers[e.currentVersion]
+	if pepperConfigured && (!peppered || version != e.currentVersion) {
+		return true
+	}
+	return e.delegate.NeedsRehash(innerHash)
+}
+
+func NewPepperedPasswordEncoder(delegate PasswordEncoder, peppers map[int][]byte,
+	currentVersion int) (*PepperedPasswordEncoder, error) {
+	if currentVersion == 0 {
+		for version := range peppers {
+			if version > currentVersion {
+				currentVersion = version
+			}
+		}
+	} else if _, ok := peppers[currentVersion]; !ok {
+		return nil, fmt.Errorf("%w: version %d", ErrUnknownPepperVersion, currentVersion)
+	}
+	return &PepperedPasswordEncoder{
+		delegate:       delegate,
+		peppers:        peppers,
+		currentVersion: currentVersion,
+	}, nil
+}
+
+func ParsePeppers(entries []string) (map[int][]byte, error) {
+	peppers := make(map[int][]byte)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		versionStr, secret, ok := strings.Cut(entry, ":")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version <= 0 || secret == "" {
+			return nil, fmt.Errorf("invalid pepper entry, expected <version>:<secret>")
+		}
+		peppers[version] = []byte(secret)
+	}
+	return peppers, nil
+}
+
+func LoadPepperFile(path string) (map[int][]byte, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePeppers(strings.Split(string(bytes), "\n"))
+}
+
+func applyPepper(pepper []byte, password string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func splitPepperedHash(hash string) (int, string, bool) {
+	if !strings.HasPrefix(hash, pepperHashPrefix) {
+		return 0, hash, false
+	}
+	rest := strings.TrimPrefix(hash, pepperHashPrefix)
+	end := strings.Index(rest, "$")
+	if end <= 0 {
+		return 0, hash, false
+	}
+	version, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return 0, hash, false
+	}
+	return version, rest[end:], true
+}
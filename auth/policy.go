@@ -0,0 +1,204 @@
+package auth
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultPasswordMinLength         = 10
+	defaultPasswordMaxBytes          = 72
+	defaultPasswordMinCharClasses    = 3
+	defaultPasswordMinUsernameLength = 3
+)
+
+//go:embed common_passwords.txt
+var bundledCommonPasswords string
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type PasswordPolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return "password does not satisfy policy: " + strings.Join(messages, "; ")
+}
+
+type PasswordPolicy interface {
+	Validate(username, password string) error
+}
+
+type PasswordRule interface {
+	Check(username, password string) *PolicyViolation
+}
+
+type RuleBasedPasswordPolicy struct {
+	rules []PasswordRule
+}
+
+func (p *RuleBasedPasswordPolicy) Validate(username, password string) error {
+	var violations []PolicyViolation
+	for _, rule := range p.rules {
+		if violation := rule.Check(username, password); violation != nil {
+			violations = append(violations, *violation)
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func NewRuleBasedPasswordPolicy(rules ...PasswordRule) *RuleBasedPasswordPolicy {
+	return &RuleBasedPasswordPolicy{
+		rules: rules,
+	}
+}
+
+type PasswordPolicyConfig struct {
+	MinLength         int
+	MaxBytes          int
+	MinCharClasses    int
+	MinUsernameLength int
+	CommonList        []string
+}
+
+func DefaultPasswordPolicyConfig() *PasswordPolicyConfig {
+	return &PasswordPolicyConfig{
+		MinLength:         defaultPasswordMinLength,
+		MaxBytes:          defaultPasswordMaxBytes,
+		MinCharClasses:    defaultPasswordMinCharClasses,
+		MinUsernameLength: defaultPasswordMinUsernameLength,
+	}
+}
+
+func NewDefaultPasswordPolicy(config *PasswordPolicyConfig) *RuleBasedPasswordPolicy {
+	commonPasswords := strings.Split(bundledCommonPasswords, "\n")
+	return NewRuleBasedPasswordPolicy(
+		&MinLengthRule{Min: config.MinLength},
+		&MaxBytesRule{Max: config.MaxBytes},
+		&CharacterClassesRule{Min: config.MinCharClasses},
+		&NoUsernameRule{MinLength: config.MinUsernameLength},
+		NewCommonPasswordRule(append(commonPasswords, config.CommonList...)),
+	)
+}
+
+func LoadCommonPasswordFile(path string) ([]string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bytes), "\n"), nil
+}
+
+type MinLengthRule struct {
+	Min int
+}
+
+func (r *MinLengthRule) Check(_, password string) *PolicyViolation {
+	if utf8.RuneCountInString(password) < r.Min {
+		return &PolicyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("password must be at least %d characters long", r.Min),
+		}
+	}
+	return nil
+}
+
+type MaxBytesRule struct {
+	Max int
+}
+
+func (r *MaxBytesRule) Check(_, password string) *PolicyViolation {
+	if r.Max > 0 && len(password) > r.Max {
+		return &PolicyViolation{
+			Rule:    "max_bytes",
+			Message: fmt.Sprintf("password must not be longer than %d bytes", r.Max),
+		}
+	}
+	return nil
+}
+
+type CharacterClassesRule struct {
+	Min int
+}
+
+func (r *CharacterClassesRule) Check(_, password string) *PolicyViolation {
+	var lower, upper, digit, symbol int
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			lower = 1
+		case unicode.IsUpper(char):
+			upper = 1
+		case unicode.IsDigit(char):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < r.Min {
+		return &PolicyViolation{
+			Rule: "character_classes",
+			Message: fmt.Sprintf("password must contain at least %d of lowercase letters, "+
+				"uppercase letters, digits and symbols", r.Min),
+		}
+	}
+	return nil
+}
+
+type NoUsernameRule struct {
+	MinLength int
+}
+
+func (r *NoUsernameRule) Check(username, password string) *PolicyViolation {
+	if username == "" || utf8.RuneCountInString(username) < r.MinLength {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return &PolicyViolation{
+			Rule:    "no_username",
+			Message: "password must not contain the username",
+		}
+	}
+	return nil
+}
+
+type CommonPasswordRule struct {
+	passwords map[string]struct{}
+}
+
+func (r *CommonPasswordRule) Check(_, password string) *PolicyViolation {
+	if _, common := r.passwords[strings.ToLower(password)]; common {
+		return &PolicyViolation{
+			Rule:    "common_password",
+			Message: "password is too common",
+		}
+	}
+	return nil
+}
+
+func NewCommonPasswordRule(passwords []string) *CommonPasswordRule {
+	set := make(map[string]struct{}, len(passwords))
+	for _, password := range passwords {
+		password = strings.TrimSpace(password)
+		if password != "" {
+			set[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return &CommonPasswordRule{
+		passwords: set,
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPasswordRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     PasswordRule
+		username string
+		password string
+		want     string
+	}{
+		{"min length met", &MinLengthRule{Min: 10}, "alice", "abcdefghij", ""},
+		{"min length counts runes", &MinLengthRule{Min: 4}, "alice", "äöüß", ""},
+		{"min length violated", &MinLengthRule{Min: 10}, "alice", "abcdefghi", "min_length"},
+		{"max bytes met", &MaxBytesRule{Max: 8}, "alice", "abcdefgh", ""},
+		{"max bytes counts bytes", &MaxBytesRule{Max: 7}, "alice", "äöüß", "max_bytes"},
+		{"max bytes disabled", &MaxBytesRule{}, "alice", "abcdefghijklmnopqrstuvwxyz", ""},
+		{"character classes met", &CharacterClassesRule{Min: 3}, "alice", "abcDEF123", ""},
+		{"character classes with symbol", &CharacterClassesRule{Min: 4}, "alice", "aB1!", ""},
+		{"character classes violated", &CharacterClassesRule{Min: 3}, "alice", "abcdef123", "character_classes"},
+		{"no username met", &NoUsernameRule{MinLength: 3}, "alice", "correct horse", ""},
+		{"no username violated", &NoUsernameRule{MinLength: 3}, "alice", "my-ALICE-pass", "no_username"},
+		{"no username short username", &NoUsernameRule{MinLength: 3}, "al", "gallant alpaca", ""},
+		{"no username empty username", &NoUsernameRule{}, "", "anything", ""},
+		{"common password met", NewCommonPasswordRule([]string{"password", " letmein "}), "alice", "correct horse", ""},
+		{"common password violated", NewCommonPasswordRule([]string{"password", " letmein "}), "alice", "LetMeIn", "common_password"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			violation := c.rule.Check(c.username, c.password)
+			got := ""
+			if violation != nil {
+				got = violation.Rule
+			}
+			if got != c.want {
+				t.Fatalf("violation = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDefaultPasswordPolicy(t *testing.T) {
+	policy := NewDefaultPasswordPolicy(DefaultPasswordPolicyConfig())
+
+	if err := policy.Validate("alice", "Tr0ub4dor&3x"); err != nil {
+		t.Fatalf("strong password rejected: %v", err)
+	}
+	err := policy.Validate("alice", "alice")
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("err = %v, want a policy error", err)
+	}
+	rules := map[string]bool{}
+	for _, violation := range policyErr.Violations {
+		rules[violation.Rule] = true
+	}
+	for _, rule := range []string{"min_length", "character_classes", "no_username"} {
+		if !rules[rule] {
+			t.Errorf("violations = %v, want %s", policyErr.Violations, rule)
+		}
+	}
+}
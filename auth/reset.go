@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"gin-auth/mail"
+	"gin-auth/persist"
+	"gin-auth/util"
+	netmail "net/mail"
+	"time"
+)
+
+const resetTokenSize = 32
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+type PasswordResetConfig struct {
+	TTL       time.Duration
+	ResetUrl  string
+	Workers   int
+	QueueSize int
+}
+
+func DefaultPasswordResetConfig() *PasswordResetConfig {
+	return &PasswordResetConfig{
+		TTL:       time.Minute * 30,
+		ResetUrl:  "http://localhost:9000/password/reset",
+		Workers:   2,
+		QueueSize: 100,
+	}
+}
+
+type PasswordResetService interface {
+	RequestReset(username string) error
+	ResetPassword(token, password string) (*persist.User, error)
+}
+
+type DefaultPasswordResetService struct {
+	userRepo    persist.UserRepository
+	resetRepo   persist.PasswordResetTokenRepository
+	passEncoder PasswordEncoder
+	passPolicy  PasswordPolicy
+	mailer      mail.Mailer
+	config      *PasswordResetConfig
+}
+
+func (s *DefaultPasswordResetService) RequestReset(username string) error {
+	user, err := s.userRepo.FindByUsername(username)
+	if err != nil {
+		return nil
+	}
+	recipient, ok := mailRecipient(user)
+	if !ok {
+		return fmt.Errorf("user %s has no mail address", user.Username)
+	}
+	err = s.resetRepo.DeleteAllByOwnerUsername(user.Username)
+	if err != nil {
+		return err
+	}
+	token, err := util.GenerateRandomToken(resetTokenSize)
+	if err != nil {
+		return err
+	}
+	err = s.resetRepo.Save(&persist.PasswordResetToken{
+		TokenHash:  util.HashToken(token),
+		OwnerRefer: user.Username,
+		ExpiresAt:  time.Now().Add(s.config.TTL),
+	})
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(&mail.Message{
+		To:      recipient,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("A password reset was requested for %s.\n\n"+
+			"Reset token: %s\n"+
+			"Reset link: %s?token=%s\n\n"+
+			"The token expires in %s. If you did not request a reset, ignore this message.\n",
+			user.Username, token, s.config.ResetUrl, token, s.config.TTL),
+	})
+}
+
+func (s *DefaultPasswordResetService) ResetPassword(token, password string) (*persist.User, error) {
+	stored, err := s.resetRepo.FindByHash(util.HashToken(token))
+	if err != nil || stored.Used || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidResetToken
+	}
+	err = s.passPolicy.Validate(stored.OwnerRefer, password)
+	if err != nil {
+		return nil, err
+	}
+	marked, err := s.resetRepo.MarkUsed(stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ErrInvalidResetToken
+	}
+	user, err := s.userRepo.FindByUsername(stored.OwnerRefer)
+	if err != nil {
+		return nil, ErrInvalidResetToken
+	}
+	hash, err := s.passEncoder.Encode(password)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = hash
+	err = s.userRepo.Update(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func NewDefaultPasswordResetService(userRepo persist.UserRepository, resetRepo persist.PasswordResetTokenRepository,
+	passEncoder PasswordEncoder, passPolicy PasswordPolicy, mailer mail.Mailer,
+	config *PasswordResetConfig) PasswordResetService {
+	return &DefaultPasswordResetService{
+		userRepo:    userRepo,
+		resetRepo:   resetRepo,
+		passEncoder: passEncoder,
+		passPolicy:  passPolicy,
+		mailer:      mailer,
+		config:      config,
+	}
+}
+
+func mailRecipient(user *persist.User) (string, bool) {
+	if user.Email == "" {
+		return "", false
+	}
+	address, err := netmail.ParseAddress(user.Email)
+	if err != nil {
+		return "", false
+	}
+	return address.Address, true
+}
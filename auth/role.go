@@ -1,6 +1,9 @@
 package auth
 
-import "fmt"
+import (
+	"fmt"
+	"gin-auth/persist"
+)
 
 const (
 	RoleAdmin     = "ADMIN"
@@ -13,7 +16,7 @@ const (
 const (
 	AdminUsername    = "admin"
 	AdminPassword    = "password"
-	AdminInsertQuery = "INSERT OR IGNORE INTO users (username,password) VALUES ('%s','%s')"
+	AdminInsertQuery = "INSERT OR IGNORE INTO users (username,password,email_verified) VALUES ('%s','%s',true)"
 )
 
 var InsertRolesQuery = fmt.Sprintf("INSERT OR IGNORE INTO roles (name) VALUES "+
@@ -31,3 +34,12 @@ func GenerateInsertAdminQuery(encoder PasswordEncoder) string {
 	}
 	return fmt.Sprintf(AdminInsertQuery, AdminUsername, encodedPassword)
 }
+
+func ContainsRole(roles []persist.Role, name string) bool {
+	for _, role := range roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"fmt"
+	"gin-auth/persist"
+	"strings"
+)
+
+const (
+	ScopePosts    = "posts"
+	ScopeModerate = "moderate"
+	ScopeManage   = "manage"
+	ScopeAdmin    = "admin"
+)
+
+type ScopeRoleMapping map[string]string
+
+func DefaultScopeRoleMapping() ScopeRoleMapping {
+	return ScopeRoleMapping{
+		ScopePosts:    RoleUser,
+		ScopeModerate: RoleModerator,
+		ScopeManage:   RoleManager,
+		ScopeAdmin:    RoleAdmin,
+	}
+}
+
+func ParseScopeRoleMapping(entries []string) (ScopeRoleMapping, error) {
+	return parseRoleMapping(entries)
+}
+
+func (m ScopeRoleMapping) Roles(scopes []string) []persist.Role {
+	var roles []persist.Role
+	for _, scope := range scopes {
+		if role, ok := m[scope]; ok && !ContainsRole(roles, role) {
+			roles = append(roles, persist.Role{Name: role})
+		}
+	}
+	return roles
+}
+
+func (m ScopeRoleMapping) Restrict(user *persist.User, scopes []string) *persist.User {
+	granted := m.Roles(scopes)
+	restricted := *user
+	restricted.Roles = nil
+	for _, role := range user.Roles {
+		if ContainsRole(granted, role.Name) {
+			restricted.Roles = append(restricted.Roles, role)
+		}
+	}
+	return &restricted
+}
+
+func parseRoleMapping(entries []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, entry := range entries {
+		name, role, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || role == "" {
+			return nil, fmt.Errorf("invalid role mapping, expected name=ROLE: %s", entry)
+		}
+		mapping[name] = role
+	}
+	return mapping, nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptLogN       = 15
+	scryptBlockSize  = 8
+	scryptParallel   = 1
+	scryptSaltLength = 16
+	scryptKeyLength  = 32
+)
+
+type ScryptPasswordEncoder struct {
+	logN        int
+	blockSize   int
+	parallelism int
+}
+
+func (e *ScryptPasswordEncoder) Encode(password string) (string, error) {
+	salt, err := generateSalt(scryptSaltLength)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<e.logN, e.blockSize, e.parallelism, scryptKeyLength)
+	if err != nil {
+		return "", err
+	}
+	params := fmt.Sprintf("ln=%d,r=%d,p=%d", e.logN, e.blockSize, e.parallelism)
+	return encodePhcHash(EncoderScrypt, params, salt, key), nil
+}
+
+func (e *ScryptPasswordEncoder) Compare(hash, raw string) bool {
+	logN, blockSize, parallelism, salt, key, err := decodeScryptHash(hash)
+	if err != nil {
+		return false
+	}
+	other, err := scrypt.Key([]byte(raw), salt, 1<<logN, blockSize, parallelism, len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (e *ScryptPasswordEncoder) NeedsRehash(hash string) bool {
+	logN, blockSize, parallelism, _, _, err := decodeScryptHash(hash)
+	return err != nil || logN < e.logN || blockSize < e.blockSize || parallelism < e.parallelism
+}
+
+func NewScryptPasswordEncoder() *ScryptPasswordEncoder {
+	return &ScryptPasswordEncoder{
+		logN:        scryptLogN,
+		blockSize:   scryptBlockSize,
+		parallelism: scryptParallel,
+	}
+}
+
+func decodeScryptHash(hash string) (logN, blockSize, parallelism int, salt, key []byte, err error) {
+	if encoderId(hash) != EncoderScrypt {
+		return 0, 0, 0, nil, nil, errInvalidHash
+	}
+	params, salt, key, err := decodePhcHash(hash)
+	if err != nil || len(params) != 1 {
+		return 0, 0, 0, nil, nil, errInvalidHash
+	}
+	_, err = fmt.Sscanf(params[0], "ln=%d,r=%d,p=%d", &logN, &blockSize, &parallelism)
+	if err != nil || logN <= 0 || logN > 30 || len(key) == 0 {
+		return 0, 0, 0, nil, nil, errInvalidHash
+	}
+	return logN, blockSize, parallelism, salt, key, nil
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"errors"
+	"gin-auth/auth/jwt"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"strings"
+	"time"
+)
+
+const RefreshTokenTTL = time.Hour * 24 * 30
+const refreshTokenSize = 32
+const refreshTokenFamilySize = 16
+
+const TokenTypeBearer = "Bearer"
+
+const ClaimClientId = jwt.ClaimClientId
+const ClaimScope = "scope"
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+var ErrRefreshTokenReused = errors.New("refresh token reused, token family revoked")
+var ErrEmailNotVerified = errors.New("email not verified")
+
+type TokenPair struct {
+	AccessToken           string `json:"access_token"`
+	RefreshToken          string `json:"refresh_token,omitempty"`
+	TokenType             string `json:"token_type"`
+	ExpiresIn             int64  `json:"expires_in"`
+	Scope                 string `json:"scope,omitempty"`
+	IdToken               string `json:"id_token,omitempty"`
+	MfaEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+}
+
+type ClientGrant struct {
+	ClientId string
+	Scopes   []string
+}
+
+func (g *ClientGrant) Scope() string {
+	return strings.Join(g.Scopes, " ")
+}
+
+func (g *ClientGrant) TokenOptions() []jwt.TokenOption {
+	return []jwt.TokenOption{
+		jwt.WithClaim(ClaimClientId, g.ClientId),
+		jwt.WithClaim(ClaimScope, g.Scope()),
+	}
+}
+
+type TokenService interface {
+	Issue(user *persist.User) (*TokenPair, error)
+	IssueForClient(user *persist.User, grant *ClientGrant) (*TokenPair, error)
+	Refresh(refreshToken string) (*TokenPair, error)
+	RefreshForClient(refreshToken, clientId string) (*TokenPair, error)
+	Revoke(username, refreshToken string) error
+	RevokeAll(username string) error
+	RevokeClient(username, clientId string) error
+}
+
+type DefaultTokenService struct {
+	jwtService  jwt.JwtService
+	userRepo    persist.UserRepository
+	refreshRepo persist.RefreshTokenRepository
+	emailPolicy UnverifiedEmailPolicy
+	mfaService  MfaService
+	scopeRoles  ScopeRoleMapping
+}
+
+func (s *DefaultTokenService) Issue(user *persist.User) (*TokenPair, error) {
+	return s.IssueForClient(user, nil)
+}
+
+func (s *DefaultTokenService) IssueForClient(user *persist.User, grant *ClientGrant) (*TokenPair, error) {
+	family, err := util.GenerateRandomToken(refreshTokenFamilySize)
+	if err != nil {
+		return nil, err
+	}
+	return s.issue(user, family, grant)
+}
+
+func (s *DefaultTokenService) Refresh(refreshToken string) (*TokenPair, error) {
+	return s.RefreshForClient(refreshToken, "")
+}
+
+func (s *DefaultTokenService) RefreshForClient(refreshToken, clientId string) (*TokenPair, error) {
+	stored, err := s.refreshRepo.FindByHash(util.HashToken(refreshToken))
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if stored.Revoked || time.Now().After(stored.ExpiresAt) || stored.ClientId != clientId {
+		return nil, ErrInvalidRefreshToken
+	}
+	if stored.Used {
+		return nil, s.revokeFamily(stored.Family)
+	}
+	marked, err := s.refreshRepo.MarkUsed(stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, s.revokeFamily(stored.Family)
+	}
+	user, err := s.userRepo.FindByUsername(stored.OwnerRefer)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	var grant *ClientGrant
+	if stored.ClientId != "" {
+		grant = &ClientGrant{ClientId: stored.ClientId, Scopes: strings.Fields(stored.Scopes)}
+	}
+	pair, err := s.issue(user, stored.Family, grant)
+	if err == ErrEmailNotVerified {
+		return nil, ErrInvalidRefreshToken
+	}
+	return pair, err
+}
+
+func (s *DefaultTokenService) Revoke(username, refreshToken string) error {
+	stored, err := s.refreshRepo.FindByHash(util.HashToken(refreshToken))
+	if err != nil || stored.OwnerRefer != username {
+		return ErrInvalidRefreshToken
+	}
+	return s.refreshRepo.RevokeFamily(stored.Family)
+}
+
+func (s *DefaultTokenService) RevokeAll(username string) error {
+	err := s.refreshRepo.RevokeAllByOwnerUsername(username)
+	if err != nil {
+		return err
+	}
+	return s.jwtService.RevokeAllTokens(username)
+}
+
+func (s *DefaultTokenService) RevokeClient(username, clientId string) error {
+	err := s.refreshRepo.RevokeAllByOwnerUsernameAndClientId(username, clientId)
+	if err != nil {
+		return err
+	}
+	return s.jwtService.RevokeClientTokens(username, clientId)
+}
+
+func (s *DefaultTokenService) issue(user *persist.User, family string, grant *ClientGrant) (*TokenPair, error) {
+	user, ok := s.emailPolicy.Apply(user)
+	if !ok {
+		return nil, ErrEmailNotVerified
+	}
+	user, enrollmentRequired, err := s.mfaService.Restrict(user)
+	if err != nil {
+		return nil, err
+	}
+	var options []jwt.TokenOption
+	refresh := &persist.RefreshToken{
+		Family:     family,
+		OwnerRefer: user.Username,
+		ExpiresAt:  time.Now().Add(RefreshTokenTTL),
+	}
+	if grant != nil {
+		user = s.scopeRoles.Restrict(user, grant.Scopes)
+		options = append(options, grant.TokenOptions()...)
+		refresh.ClientId = grant.ClientId
+		refresh.Scopes = grant.Scope()
+	}
+	accessToken, err := s.jwtService.GenerateToken(user, options...)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := util.GenerateRandomToken(refreshTokenSize)
+	if err != nil {
+		return nil, err
+	}
+	refresh.TokenHash = util.HashToken(refreshToken)
+	err = s.refreshRepo.Save(refresh)
+	if err != nil {
+		return nil, err
+	}
+	pair := &TokenPair{
+		AccessToken:           accessToken,
+		RefreshToken:          refreshToken,
+		TokenType:             TokenTypeBearer,
+		ExpiresIn:             int64(s.jwtService.TokenTTL().Seconds()),
+		MfaEnrollmentRequired: enrollmentRequired,
+	}
+	if grant != nil {
+		pair.Scope = grant.Scope()
+	}
+	return pair, nil
+}
+
+func (s *DefaultTokenService) revokeFamily(family string) error {
+	err := s.refreshRepo.RevokeFamily(family)
+	if err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+func NewDefaultTokenService(jwtService jwt.JwtService, userRepo persist.UserRepository,
+	refreshRepo persist.RefreshTokenRepository, emailPolicy UnverifiedEmailPolicy, mfaService MfaService,
+	scopeRoles ScopeRoleMapping) TokenService {
+	return &DefaultTokenService{
+		jwtService:  jwtService,
+		userRepo:    userRepo,
+		refreshRepo: refreshRepo,
+		emailPolicy: emailPolicy,
+		mfaService:  mfaService,
+		scopeRoles:  scopeRoles,
+	}
+}
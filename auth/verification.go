@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"gin-auth/mail"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"time"
+)
+
+const verificationTokenSize = 32
+
+const (
+	UnverifiedEmailAllow     = "allow"
+	UnverifiedEmailDeny      = "deny"
+	UnverifiedEmailAnonymous = "anonymous"
+)
+
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+var ErrVerificationRateLimited = errors.New("too many verification mails requested, try again later")
+
+type UnverifiedEmailPolicy string
+
+func (p UnverifiedEmailPolicy) Apply(user *persist.User) (*persist.User, bool) {
+	if user.EmailVerified {
+		return user, true
+	}
+	switch p {
+	case UnverifiedEmailDeny:
+		return nil, false
+	case UnverifiedEmailAnonymous:
+		restricted := *user
+		restricted.Roles = []persist.Role{{Name: RoleAnonymous}}
+		return &restricted, true
+	default:
+		return user, true
+	}
+}
+
+type VerifiedEmailLoginService struct {
+	delegate LoginService
+	policy   UnverifiedEmailPolicy
+}
+
+func (s *VerifiedEmailLoginService) Login(username, password string) (*persist.User, error) {
+	user, err := s.delegate.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := s.policy.Apply(user)
+	if !ok {
+		return nil, ErrEmailNotVerified
+	}
+	return user, nil
+}
+
+func NewVerifiedEmailLoginService(delegate LoginService, policy UnverifiedEmailPolicy) LoginService {
+	return &VerifiedEmailLoginService{
+		delegate: delegate,
+		policy:   policy,
+	}
+}
+
+type EmailVerificationConfig struct {
+	TTL            time.Duration
+	VerifyUrl      string
+	ResendWindow   time.Duration
+	MaxPerWindow   int64
+	ResendCooldown time.Duration
+	Workers        int
+	QueueSize      int
+}
+
+func DefaultEmailVerificationConfig() *EmailVerificationConfig {
+	return &EmailVerificationConfig{
+		TTL:            time.Hour * 24,
+		VerifyUrl:      "http://localhost:9000/email/verify",
+		ResendWindow:   time.Hour,
+		MaxPerWindow:   5,
+		ResendCooldown: time.Minute,
+		Workers:        2,
+		QueueSize:      100,
+	}
+}
+
+type EmailVerificationService interface {
+	SendVerification(user *persist.User) error
+	Resend(username string) error
+	Verify(token string) (*persist.User, error)
+}
+
+type DefaultEmailVerificationService struct {
+	userRepo         persist.UserRepository
+	verificationRepo persist.EmailVerificationTokenRepository
+	mailer           mail.Mailer
+	config           *EmailVerificationConfig
+}
+
+func (s *DefaultEmailVerificationService) SendVerification(user *persist.User) error {
+	if user.Email == "" || user.EmailVerified {
+		return nil
+	}
+	token, err := util.GenerateRandomToken(verificationTokenSize)
+	if err != nil {
+		return err
+	}
+	err = s.verificationRepo.Save(&persist.EmailVerificationToken{
+		TokenHash:  util.HashToken(token),
+		OwnerRefer: user.Username,
+		ExpiresAt:  time.Now().Add(s.config.TTL),
+	})
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(&mail.Message{
+		To:      user.Email,
+		Subject: "Verify your mail address",
+		Body: fmt.Sprintf("Verify the mail address of %s.\n\n"+
+			"Verification token: %s\n"+
+			"Verification link: %s?token=%s\n\n"+
+			"The token expires in %s.\n",
+			user.Username, token, s.config.VerifyUrl, token, s.config.TTL),
+	})
+}
+
+func (s *DefaultEmailVerificationService) Resend(username string) error {
+	recent, err := s.verificationRepo.CountCreatedSince(username, time.Now().Add(-s.config.ResendCooldown))
+	if err != nil {
+		return err
+	}
+	total, err := s.verificationRepo.CountCreatedSince(username, time.Now().Add(-s.config.ResendWindow))
+	if err != nil {
+		return err
+	}
+	if recent > 0 || total >= s.config.MaxPerWindow {
+		return ErrVerificationRateLimited
+	}
+	user, err := s.userRepo.FindByUsername(username)
+	if err != nil {
+		return nil
+	}
+	return s.SendVerification(user)
+}
+
+func (s *DefaultEmailVerificationService) Verify(token string) (*persist.User, error) {
+	stored, err := s.verificationRepo.FindByHash(util.HashToken(token))
+	if err != nil || stored.Used || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidVerificationToken
+	}
+	marked, err := s.verificationRepo.MarkUsed(stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ErrInvalidVerificationToken
+	}
+	err = s.userRepo.MarkEmailVerified(stored.OwnerRefer)
+	if err != nil {
+		return nil, err
+	}
+	return s.userRepo.FindByUsername(stored.OwnerRefer)
+}
+
+func NewDefaultEmailVerificationService(userRepo persist.UserRepository,
+	verificationRepo persist.EmailVerificationTokenRepository, mailer mail.Mailer,
+	config *EmailVerificationConfig) EmailVerificationService {
+	return &DefaultEmailVerificationService{
+		userRepo:         userRepo,
+		verificationRepo: verificationRepo,
+		mailer:           mailer,
+		config:           config,
+	}
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"io"
+	"strings"
+	"time"
+)
+
+const webAuthnSessionSize = 32
+
+const (
+	webAuthnCeremonyRegistration = "registration"
+	webAuthnCeremonyLogin        = "login"
+)
+
+var ErrInvalidWebAuthnSession = errors.New("invalid or expired webauthn session")
+var ErrWebAuthnVerificationFailed = errors.New("webauthn verification failed")
+var ErrWebAuthnCloneDetected = errors.New("webauthn authenticator sign count regressed, credential may be cloned")
+
+type WebAuthnConfig struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigins     []string
+	SessionTTL    time.Duration
+}
+
+func DefaultWebAuthnConfig() *WebAuthnConfig {
+	return &WebAuthnConfig{
+		RPID:          "localhost",
+		RPDisplayName: "gin-auth",
+		RPOrigins:     []string{"http://localhost:9000"},
+		SessionTTL:    time.Minute * 5,
+	}
+}
+
+type WebAuthnCeremony struct {
+	SessionId string      `json:"session_id"`
+	Options   interface{} `json:"options"`
+	ExpiresIn int64       `json:"expires_in"`
+}
+
+type WebAuthnService interface {
+	BeginRegistration(user *persist.User) (*WebAuthnCeremony, error)
+	FinishRegistration(user *persist.User, sessionId, name string, response io.Reader) (*persist.WebAuthnCredential, error)
+	BeginLogin() (*WebAuthnCeremony, error)
+	FinishLogin(sessionId string, response io.Reader) (*persist.User, error)
+	Credentials(username string) ([]*persist.WebAuthnCredential, error)
+	DeleteCredential(username string, id uint) (bool, error)
+}
+
+type DefaultWebAuthnService struct {
+	webAuthn       *webauthn.WebAuthn
+	userRepo       persist.UserRepository
+	credentialRepo persist.WebAuthnCredentialRepository
+	sessionRepo    persist.WebAuthnSessionRepository
+	config         *WebAuthnConfig
+}
+
+func (s *DefaultWebAuthnService) BeginRegistration(user *persist.User) (*WebAuthnCeremony, error) {
+	account, err := s.account(user)
+	if err != nil {
+		return nil, err
+	}
+	exclusions := make([]protocol.CredentialDescriptor, len(account.credentials))
+	for i, credential := range account.credentials {
+		exclusions[i] = credential.Descriptor()
+	}
+	creation, session, err := s.webAuthn.BeginRegistration(account,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.saveSession(user.Username, webAuthnCeremonyRegistration, session, creation)
+}
+
+func (s *DefaultWebAuthnService) FinishRegistration(user *persist.User, sessionId, name string,
+	response io.Reader) (*persist.WebAuthnCredential, error) {
+	session, err := s.consumeSession(sessionId, webAuthnCeremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if session.OwnerRefer != user.Username {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	account, err := s.account(user)
+	if err != nil {
+		return nil, err
+	}
+	created, err := s.webAuthn.CreateCredential(account, *session.data, parsed)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	transports := make([]string, len(created.Transport))
+	for i, transport := range created.Transport {
+		transports[i] = string(transport)
+	}
+	credential := &persist.WebAuthnCredential{
+		OwnerRefer:      user.Username,
+		Name:            name,
+		CredentialId:    created.ID,
+		PublicKey:       created.PublicKey,
+		AttestationType: created.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		Aaguid:          created.Authenticator.AAGUID,
+		SignCount:       created.Authenticator.SignCount,
+		BackupEligible:  created.Flags.BackupEligible,
+		BackupState:     created.Flags.BackupState,
+	}
+	err = s.credentialRepo.Save(credential)
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (s *DefaultWebAuthnService) BeginLogin() (*WebAuthnCeremony, error) {
+	assertion, session, err := s.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, err
+	}
+	return s.saveSession("", webAuthnCeremonyLogin, session, assertion)
+}
+
+func (s *DefaultWebAuthnService) FinishLogin(sessionId string, response io.Reader) (*persist.User, error) {
+	session, err := s.consumeSession(sessionId, webAuthnCeremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	stored, err := s.credentialRepo.FindByCredentialId(parsed.RawID)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	user, err := s.userRepo.FindByUsername(stored.OwnerRefer)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	account, err := s.account(user)
+	if err != nil {
+		return nil, err
+	}
+	validated, err := s.webAuthn.ValidateDiscoverableLogin(
+		func(rawId, userHandle []byte) (webauthn.User, error) {
+			if !bytes.Equal(userHandle, account.WebAuthnID()) {
+				return nil, ErrWebAuthnVerificationFailed
+			}
+			return account, nil
+		}, *session.data, parsed)
+	if err != nil {
+		return nil, ErrWebAuthnVerificationFailed
+	}
+	now := time.Now()
+	stored.SignCount = validated.Authenticator.SignCount
+	stored.CloneWarning = stored.CloneWarning || validated.Authenticator.CloneWarning
+	stored.BackupState = validated.Flags.BackupState
+	stored.LastUsedAt = &now
+	err = s.credentialRepo.UpdateUsage(stored)
+	if err != nil {
+		return nil, err
+	}
+	if stored.CloneWarning {
+		return nil, ErrWebAuthnCloneDetected
+	}
+	return user, nil
+}
+
+func (s *DefaultWebAuthnService) Credentials(username string) ([]*persist.WebAuthnCredential, error) {
+	return s.credentialRepo.FindAllByOwnerUsername(username)
+}
+
+func (s *DefaultWebAuthnService) DeleteCredential(username string, id uint) (bool, error) {
+	return s.credentialRepo.Delete(username, id)
+}
+
+type webAuthnSession struct {
+	*persist.WebAuthnSession
+	data *webauthn.SessionData
+}
+
+func (s *DefaultWebAuthnService) saveSession(username, ceremony string, session *webauthn.SessionData,
+	options interface{}) (*WebAuthnCeremony, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	token, err := util.GenerateRandomToken(webAuthnSessionSize)
+	if err != nil {
+		return nil, err
+	}
+	err = s.sessionRepo.Save(&persist.WebAuthnSession{
+		TokenHash:  util.HashToken(token),
+		OwnerRefer: username,
+		Ceremony:   ceremony,
+		Data:       string(data),
+		ExpiresAt:  time.Now().Add(s.config.SessionTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnCeremony{
+		SessionId: token,
+		Options:   options,
+		ExpiresIn: int64(s.config.SessionTTL.Seconds()),
+	}, nil
+}
+
+func (s *DefaultWebAuthnService) consumeSession(sessionId, ceremony string) (*webAuthnSession, error) {
+	stored, err := s.sessionRepo.FindByHash(util.HashToken(sessionId))
+	if err != nil || stored.Used || stored.Ceremony != ceremony || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	marked, err := s.sessionRepo.MarkUsed(stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !marked {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	data := new(webauthn.SessionData)
+	err = json.Unmarshal([]byte(stored.Data), data)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnSession{WebAuthnSession: stored, data: data}, nil
+}
+
+func (s *DefaultWebAuthnService) account(user *persist.User) (*webAuthnAccount, error) {
+	stored, err := s.credentialRepo.FindAllByOwnerUsername(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]webauthn.Credential, len(stored))
+	for i, credential := range stored {
+		credentials[i] = webauthn.Credential{
+			ID:              credential.CredentialId,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       parseTransports(credential.Transports),
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       credential.Aaguid,
+				SignCount:    credential.SignCount,
+				CloneWarning: credential.CloneWarning,
+			},
+		}
+	}
+	return &webAuthnAccount{user: user, credentials: credentials}, nil
+}
+
+type webAuthnAccount struct {
+	user        *persist.User
+	credentials []webauthn.Credential
+}
+
+func (a *webAuthnAccount) WebAuthnID() []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(a.user.ID))
+	return id
+}
+
+func (a *webAuthnAccount) WebAuthnName() string {
+	return a.user.Username
+}
+
+func (a *webAuthnAccount) WebAuthnDisplayName() string {
+	return a.user.Username
+}
+
+func (a *webAuthnAccount) WebAuthnCredentials() []webauthn.Credential {
+	return a.credentials
+}
+
+func (a *webAuthnAccount) WebAuthnIcon() string {
+	return ""
+}
+
+func parseTransports(transports string) []protocol.AuthenticatorTransport {
+	var parsed []protocol.AuthenticatorTransport
+	for _, transport := range strings.Split(transports, ",") {
+		if transport != "" {
+			parsed = append(parsed, protocol.AuthenticatorTransport(transport))
+		}
+	}
+	return parsed
+}
+
+func NewDefaultWebAuthnService(userRepo persist.UserRepository, credentialRepo persist.WebAuthnCredentialRepository,
+	sessionRepo persist.WebAuthnSessionRepository, config *WebAuthnConfig) (WebAuthnService, error) {
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: config.RPDisplayName,
+		RPOrigins:     config.RPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DefaultWebAuthnService{
+		webAuthn:       webAuthn,
+		userRepo:       userRepo,
+		credentialRepo: credentialRepo,
+		sessionRepo:    sessionRepo,
+		config:         config,
+	}, nil
+}
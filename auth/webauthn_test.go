@@ -0,0 +1,386 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"gin-auth/persist"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebAuthnOrigin = "http://localhost:9000"
+
+const (
+	authenticatorFlagUserPresent  = 0x01
+	authenticatorFlagUserVerified = 0x04
+	authenticatorFlagAttested     = 0x40
+)
+
+type memoryWebAuthnCredentialRepository struct {
+	mu          sync.Mutex
+	credentials []*persist.WebAuthnCredential
+}
+
+func (r *memoryWebAuthnCredentialRepository) Save(credential *persist.WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	credential.ID = uint(len(r.credentials) + 1)
+	r.credentials = append(r.credentials, credential)
+	return nil
+}
+
+func (r *memoryWebAuthnCredentialRepository) FindAllByOwnerUsername(ownerUsername string) ([]*persist.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []*persist.WebAuthnCredential
+	for _, credential := range r.credentials {
+		if credential.OwnerRefer == ownerUsername {
+			copied := *credential
+			found = append(found, &copied)
+		}
+	}
+	return found, nil
+}
+
+func (r *memoryWebAuthnCredentialRepository) FindByCredentialId(credentialId []byte) (*persist.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, credential := range r.credentials {
+		if bytes.Equal(credential.CredentialId, credentialId) {
+			copied := *credential
+			return &copied, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *memoryWebAuthnCredentialRepository) UpdateUsage(credential *persist.WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, stored := range r.credentials {
+		if stored.ID == credential.ID {
+			copied := *credential
+			r.credentials[i] = &copied
+		}
+	}
+	return nil
+}
+
+func (r *memoryWebAuthnCredentialRepository) Delete(ownerUsername string, id uint) (bool, error) {
+	return false, nil
+}
+
+type memoryWebAuthnSessionRepository struct {
+	mu       sync.Mutex
+	sessions []*persist.WebAuthnSession
+}
+
+func (r *memoryWebAuthnSessionRepository) Save(session *persist.WebAuthnSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session.ID = uint(len(r.sessions) + 1)
+	r.sessions = append(r.sessions, session)
+	return nil
+}
+
+func (r *memoryWebAuthnSessionRepository) FindByHash(hash string) (*persist.WebAuthnSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, session := range r.sessions {
+		if session.TokenHash == hash {
+			copied := *session
+			return &copied, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *memoryWebAuthnSessionRepository) MarkUsed(id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, session := range r.sessions {
+		if session.ID == id && !session.Used {
+			session.Used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type softwareAuthenticator struct {
+	rpId         string
+	credentialId []byte
+	key          *ecdsa.PrivateKey
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T, rpId string) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softwareAuthenticator{rpId: rpId, credentialId: credentialId, key: key}
+}
+
+func (a *softwareAuthenticator) authenticatorData(flags byte, attestedCredential []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedCredential...)
+}
+
+func (a *softwareAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge.String(),
+		"origin":    testWebAuthnOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *softwareAuthenticator) create(t *testing.T, ceremony *WebAuthnCeremony) []byte {
+	options := ceremony.Options.(*protocol.CredentialCreation).Response
+	a.userHandle = options.User.ID.(protocol.URLEncodedBase64)
+	publicKey, err := webauthncbor.Marshal(&webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, publicKey...)
+	flags := byte(authenticatorFlagUserPresent | authenticatorFlagUserVerified | authenticatorFlagAttested)
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(flags, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encodeBase64Url(a.clientData(t, "webauthn.create", options.Challenge)),
+		"attestationObject": encodeBase64Url(attestation),
+	})
+}
+
+func (a *softwareAuthenticator) get(t *testing.T, ceremony *WebAuthnCeremony) []byte {
+	options := ceremony.Options.(*protocol.CredentialAssertion).Response
+	a.signCount++
+	authData := a.authenticatorData(authenticatorFlagUserPresent|authenticatorFlagUserVerified, nil)
+	clientData := a.clientData(t, "webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encodeBase64Url(clientData),
+		"authenticatorData": encodeBase64Url(authData),
+		"signature":         encodeBase64Url(signature),
+		"userHandle":        encodeBase64Url(a.userHandle),
+	})
+}
+
+func (a *softwareAuthenticator) response(t *testing.T, response map[string]string) []byte {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":       encodeBase64Url(a.credentialId),
+		"rawId":    encodeBase64Url(a.credentialId),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func encodeBase64Url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newTestWebAuthnService(t *testing.T, users ...*persist.User) (WebAuthnService, *memoryWebAuthnCredentialRepository) {
+	credentialRepo := &memoryWebAuthnCredentialRepository{}
+	config := DefaultWebAuthnConfig()
+	config.RPOrigins = []string{testWebAuthnOrigin}
+	service, err := NewDefaultWebAuthnService(newMemoryUserRepository(users...), credentialRepo,
+		&memoryWebAuthnSessionRepository{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service, credentialRepo
+}
+
+func registerSoftwareAuthenticator(t *testing.T, service WebAuthnService, user *persist.User) *softwareAuthenticator {
+	ceremony, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newSoftwareAuthenticator(t, DefaultWebAuthnConfig().RPID)
+	_, err = service.FinishRegistration(user, ceremony.SessionId, "laptop",
+		bytes.NewReader(authenticator.create(t, ceremony)))
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	return authenticator
+}
+
+func TestWebAuthnLoginWithSoftwareAuthenticator(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	service, credentialRepo := newTestWebAuthnService(t, bob)
+	authenticator := registerSoftwareAuthenticator(t, service, bob)
+
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed := ceremony.Options.(*protocol.CredentialAssertion).Response.AllowedCredentials; len(allowed) != 0 {
+		t.Fatalf("login challenge lists %d credentials, want a discoverable challenge", len(allowed))
+	}
+	user, err := service.FinishLogin(ceremony.SessionId, bytes.NewReader(authenticator.get(t, ceremony)))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if user.Username != "bob" {
+		t.Fatalf("logged in as %q, want bob", user.Username)
+	}
+	stored, _ := credentialRepo.FindByCredentialId(authenticator.credentialId)
+	if stored.SignCount != authenticator.signCount || stored.LastUsedAt == nil {
+		t.Fatalf("credential usage not recorded: sign count %d, last used %v", stored.SignCount, stored.LastUsedAt)
+	}
+}
+
+func TestWebAuthnBeginLoginDoesNotDependOnAccount(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	service, _ := newTestWebAuthnService(t, bob)
+	registerSoftwareAuthenticator(t, service, bob)
+
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := ceremony.Options.(*protocol.CredentialAssertion).Response
+	if len(options.AllowedCredentials) != 0 || options.RelyingPartyID != DefaultWebAuthnConfig().RPID {
+		t.Fatalf("unexpected login options: %+v", options)
+	}
+}
+
+func TestWebAuthnLoginRejectsReplayedSession(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	service, _ := newTestWebAuthnService(t, bob)
+	authenticator := registerSoftwareAuthenticator(t, service, bob)
+
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := authenticator.get(t, ceremony)
+	_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader(response))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader(response))
+	if err != ErrInvalidWebAuthnSession {
+		t.Fatalf("replayed session error = %v, want %v", err, ErrInvalidWebAuthnSession)
+	}
+}
+
+func TestWebAuthnLoginRejectsForeignUserHandle(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	eve := &persist.User{Username: "eve"}
+	eve.ID = 8
+	service, _ := newTestWebAuthnService(t, bob, eve)
+	authenticator := registerSoftwareAuthenticator(t, service, bob)
+	registerSoftwareAuthenticator(t, service, eve)
+	authenticator.userHandle = []byte{0, 0, 0, 0, 0, 0, 0, 8}
+
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader(authenticator.get(t, ceremony)))
+	if err != ErrWebAuthnVerificationFailed {
+		t.Fatalf("foreign user handle error = %v, want %v", err, ErrWebAuthnVerificationFailed)
+	}
+}
+
+func TestWebAuthnLoginDetectsClonedAuthenticator(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	service, _ := newTestWebAuthnService(t, bob)
+	authenticator := registerSoftwareAuthenticator(t, service, bob)
+
+	for i := 0; i < 2; i++ {
+		ceremony, err := service.BeginLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader(authenticator.get(t, ceremony)))
+		if err != nil {
+			t.Fatalf("login %d failed: %v", i, err)
+		}
+	}
+	authenticator.signCount = 0
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader(authenticator.get(t, ceremony)))
+	if err != ErrWebAuthnCloneDetected {
+		t.Fatalf("regressed sign count error = %v, want %v", err, ErrWebAuthnCloneDetected)
+	}
+}
+
+func TestWebAuthnSessionExpires(t *testing.T) {
+	bob := &persist.User{Username: "bob"}
+	bob.ID = 7
+	credentialRepo := &memoryWebAuthnCredentialRepository{}
+	config := DefaultWebAuthnConfig()
+	config.SessionTTL = -time.Second
+	service, err := NewDefaultWebAuthnService(newMemoryUserRepository(bob), credentialRepo,
+		&memoryWebAuthnSessionRepository{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceremony, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.FinishLogin(ceremony.SessionId, bytes.NewReader([]byte("{}")))
+	if err != ErrInvalidWebAuthnSession {
+		t.Fatalf("expired session error = %v, want %v", err, ErrInvalidWebAuthnSession)
+	}
+}
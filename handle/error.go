@@ -1,29 +1,38 @@
 package handle
 
 import (
+	"errors"
+	"gin-auth/auth"
 	"github.com/gin-gonic/gin"
 	"time"
 )
 
 type ErrorResponse struct {
-	Status    int    `json:"status,omitempty"`
-	Path      string `json:"path,omitempty"`
-	Method    string `json:"method,omitempty"`
-	Message   string `json:"message,omitempty"`
-	Timestamp int64  `json:"timestamp,omitempty"`
+	Status     int                    `json:"status,omitempty"`
+	Path       string                 `json:"path,omitempty"`
+	Method     string                 `json:"method,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	Violations []auth.PolicyViolation `json:"violations,omitempty"`
+	Timestamp  int64                  `json:"timestamp,omitempty"`
 }
 
 func wrapError(err error, status int, c *gin.Context) *ErrorResponse {
 	if err == nil {
 		panic("error cannot be nil")
 	}
-	return &ErrorResponse{
+	response := &ErrorResponse{
 		Status:    status,
 		Path:      c.Request.RequestURI,
 		Method:    c.Request.Method,
 		Message:   err.Error(),
 		Timestamp: time.Now().UnixMilli(),
 	}
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		response.Message = "password does not satisfy policy"
+		response.Violations = policyErr.Violations
+	}
+	return response
 }
 
 func wrapErrorAndSend(err error, status int, c *gin.Context) {
@@ -0,0 +1,71 @@
+package handle
+
+import (
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+type TokenExtractor interface {
+	ExtractToken(c *gin.Context) (string, error)
+}
+
+type TokenExtractorFunc func(c *gin.Context) (string, error)
+
+func (f TokenExtractorFunc) ExtractToken(c *gin.Context) (string, error) {
+	return f(c)
+}
+
+type sessionCookieTokenExtractor struct {
+	config *SessionCookieConfig
+}
+
+func (e *sessionCookieTokenExtractor) ExtractToken(c *gin.Context) (string, error) {
+	if !e.config.Enabled || c.GetHeader(authHeader) != "" {
+		return "", nil
+	}
+	token, err := c.Cookie(e.config.cookieName(accessCookieName))
+	if err != nil || token == "" {
+		return "", nil
+	}
+	if !verifyCsrf(e.config, c) {
+		return "", ErrInvalidCsrfToken
+	}
+	return token, nil
+}
+
+func BearerTokenExtractor() TokenExtractor {
+	return HeaderTokenExtractor(authHeader, authTokenPrefix)
+}
+
+func HeaderTokenExtractor(header, prefix string) TokenExtractor {
+	return TokenExtractorFunc(func(c *gin.Context) (string, error) {
+		value := c.GetHeader(header)
+		if !strings.HasPrefix(value, prefix) {
+			return "", nil
+		}
+		return strings.TrimPrefix(value, prefix), nil
+	})
+}
+
+func WebSocketQueryTokenExtractor(param string) TokenExtractor {
+	return TokenExtractorFunc(func(c *gin.Context) (string, error) {
+		if !c.IsWebsocket() {
+			return "", nil
+		}
+		return c.Query(param), nil
+	})
+}
+
+func SessionCookieTokenExtractor(config *SessionCookieConfig) TokenExtractor {
+	return &sessionCookieTokenExtractor{config: config}
+}
+
+func extractToken(extractors []TokenExtractor, c *gin.Context) (string, TokenExtractor, error) {
+	for _, extractor := range extractors {
+		token, err := extractor.ExtractToken(c)
+		if err != nil || token != "" {
+			return token, extractor, err
+		}
+	}
+	return "", nil, nil
+}
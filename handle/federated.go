@@ -0,0 +1,161 @@
+package handle
+
+import (
+	"crypto/subtle"
+	"errors"
+	"gin-auth/auth"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const federatedStateCookie = "gin_federated_state"
+const federatedCookiePath = "/federated"
+
+func FindAllFederatedProviders(federatedService auth.FederatedService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, federatedService.Providers())
+	}
+}
+
+func BeginFederatedLogin(federatedService auth.FederatedService, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		login, err := federatedService.Begin(c.Param("provider"), "")
+		if err != nil {
+			sendFederatedError(err, c)
+			return
+		}
+		setFederatedStateCookie(cookies, login.State, int(login.ExpiresIn), c)
+		c.Redirect(http.StatusFound, login.AuthorizationUrl)
+	}
+}
+
+func BeginFederatedLink(federatedService auth.FederatedService, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		login, err := federatedService.Begin(c.Param("provider"), username)
+		if err != nil {
+			sendFederatedError(err, c)
+			return
+		}
+		setFederatedStateCookie(cookies, login.State, int(login.ExpiresIn), c)
+		c.JSON(http.StatusOK, login)
+	}
+}
+
+func FinishFederatedLogin(federatedService auth.FederatedService, tokenService auth.TokenService,
+	mfaService auth.MfaService, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if idpError := c.Query("error"); idpError != "" {
+			wrapErrorAndSend(errors.New("identity provider returned an error: "+idpError), http.StatusUnauthorized, c)
+			return
+		}
+		state := c.Query("state")
+		cookie, err := c.Cookie(federatedStateCookie)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+			wrapErrorAndSend(auth.ErrInvalidFederatedState, http.StatusUnauthorized, c)
+			return
+		}
+		setFederatedStateCookie(cookies, "", -1, c)
+		user, err := federatedService.Complete(c.Param("provider"), state, c.Query("code"))
+		if err != nil {
+			sendFederatedError(err, c)
+			return
+		}
+		mfaEnabled, err := mfaService.Enabled(user.Username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if mfaEnabled {
+			pending, err := mfaService.Challenge(user)
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			c.JSON(http.StatusAccepted, pending)
+			return
+		}
+		pair, err := tokenService.Issue(user)
+		if err == auth.ErrEmailNotVerified {
+			wrapErrorAndSend(err, http.StatusForbidden, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusOK, pair, cookies, c)
+	}
+}
+
+func FindAllFederatedIdentities(federatedService auth.FederatedService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		identities, err := federatedService.Identities(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, identities)
+	}
+}
+
+func UnlinkFederatedIdentity(federatedService auth.FederatedService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		deleted, err := federatedService.Unlink(username, uint(id))
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if !deleted {
+			wrapErrorAndSend(errors.New("no such identity"), http.StatusNotFound, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func setFederatedStateCookie(cookies *SessionCookieConfig, state string, maxAge int, c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     federatedStateCookie,
+		Value:    state,
+		Path:     federatedCookiePath,
+		MaxAge:   maxAge,
+		Secure:   cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func sendFederatedError(err error, c *gin.Context) {
+	switch {
+	case err == auth.ErrUnknownFederatedProvider:
+		wrapErrorAndSend(err, http.StatusNotFound, c)
+	case err == auth.ErrInvalidFederatedState, errors.Is(err, auth.ErrFederatedLoginFailed),
+		err == auth.ErrFederatedIdentityNotLinked:
+		wrapErrorAndSend(err, http.StatusUnauthorized, c)
+	case err == auth.ErrFederatedIdentityLinked, err == auth.ErrFederatedUsernameTaken:
+		wrapErrorAndSend(err, http.StatusConflict, c)
+	default:
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+	}
+}
@@ -1,48 +1,864 @@
 package handle
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"gin-auth/auth"
 	"gin-auth/auth/jwt"
 	"gin-auth/persist"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net/http"
+	netmail "net/mail"
 	"strconv"
+	"strings"
+	"time"
 )
 
+var log = logrus.New()
+
+var ErrResetQueueFull = errors.New("too many pending password reset requests, try again later")
+var ErrVerificationQueueFull = errors.New("too many pending verification mails, try again later")
+
 func Health(c *gin.Context) {
 	c.JSON(http.StatusOK, struct{ Status string }{Status: "UP"})
 }
 
-func Login(loginService auth.LoginService, jwtService jwt.JwtService) gin.HandlerFunc {
+func Jwks(jwtService jwt.JwtService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, jwtService.Jwks())
+	}
+}
+
+func RotateKeys(jwtService jwt.JwtService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kid, err := jwtService.RotateKeys()
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusAccepted, struct {
+			Kid string `json:"kid"`
+		}{Kid: kid})
+	}
+}
+
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Revoked   bool     `json:"revoked,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	TokenId   string   `json:"jti,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+func Introspect(jwtService jwt.JwtService, repo persist.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.PostForm("token")
+		if token == "" {
+			wrapErrorAndSend(errors.New("token is required"), http.StatusBadRequest, c)
+			return
+		}
+		claims, err := jwtService.VerifyToken(token)
+		if err != nil {
+			c.JSON(http.StatusOK, &IntrospectionResponse{Revoked: err == jwt.ErrTokenRevoked})
+			return
+		}
+		clientId, _ := claims.Custom[auth.ClaimClientId].(string)
+		response := &IntrospectionResponse{
+			Active:    true,
+			Subject:   claims.Subject,
+			ClientId:  clientId,
+			Roles:     claims.Roles,
+			TokenType: auth.TokenTypeBearer,
+			Issuer:    claims.Issuer,
+			Audience:  claims.Audience,
+			TokenId:   claims.RegisteredClaims.ID,
+			ExpiresAt: claims.ExpiresAt.Unix(),
+		}
+		if claims.IssuedAt != nil {
+			response.IssuedAt = claims.IssuedAt.Unix()
+		}
+		if claims.NotBefore != nil {
+			response.NotBefore = claims.NotBefore.Unix()
+		}
+		if claims.Username != "" {
+			user, err := repo.FindByUsername(claims.Subject)
+			if err != nil {
+				c.JSON(http.StatusOK, &IntrospectionResponse{})
+				return
+			}
+			response.Username = user.Username
+			response.Roles = rolesToString(user.Roles)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func Login(loginService auth.LoginService, tokenService auth.TokenService, mfaService auth.MfaService,
+	guard auth.LoginGuard, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		credentials := &struct {
+			Username string
+			Password string
+		}{}
+		err = json.Unmarshal(body, credentials)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		retryAfter, err := guard.Check(credentials.Username, c.ClientIP())
+		if err == auth.ErrLoginLocked {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			wrapErrorAndSend(err, http.StatusTooManyRequests, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		user, err := loginService.Login(credentials.Username, credentials.Password)
+		if err == auth.ErrEmailNotVerified {
+			if releaseLoginGuard(guard, credentials.Username, c) {
+				wrapErrorAndSend(err, http.StatusForbidden, c)
+			}
+			return
+		}
+		if err == auth.ErrInvalidCredentials {
+			err = guard.RegisterFailure(credentials.Username, c.ClientIP())
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			wrapErrorAndSend(auth.ErrInvalidCredentials, http.StatusUnauthorized, c)
+			return
+		}
+		if err != nil {
+			if releaseLoginGuard(guard, credentials.Username, c) {
+				sendLoginError(err, c)
+			}
+			return
+		}
+		mfaEnabled, err := mfaService.Enabled(user.Username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if mfaEnabled {
+			err = guard.Release(credentials.Username, c.ClientIP())
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			pending, err := mfaService.Challenge(user)
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			c.JSON(http.StatusAccepted, pending)
+			return
+		}
+		err = guard.RegisterSuccess(credentials.Username, c.ClientIP())
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		pair, err := tokenService.Issue(user)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusAccepted, pair, cookies, c)
+	}
+}
+
+func LoginMfa(mfaService auth.MfaService, tokenService auth.TokenService, guard auth.LoginGuard,
+	cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			MfaToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		username, err := mfaService.ChallengeOwner(request.MfaToken)
+		if err == auth.ErrInvalidMfaChallenge {
+			wrapErrorAndSend(err, http.StatusUnauthorized, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if !checkLoginGuard(guard, username, c) {
+			return
+		}
+		user, err := mfaService.VerifyChallenge(request.MfaToken, request.Code)
+		if err == auth.ErrInvalidMfaCode {
+			registerLoginFailure(guard, username, c)
+			return
+		}
+		if err == auth.ErrInvalidMfaChallenge || err == auth.ErrMfaNotEnrolled {
+			wrapErrorAndSend(err, http.StatusUnauthorized, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = guard.RegisterSuccess(username, c.ClientIP())
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		pair, err := tokenService.Issue(user)
+		if err == auth.ErrEmailNotVerified {
+			wrapErrorAndSend(err, http.StatusForbidden, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusAccepted, pair, cookies, c)
+	}
+}
+
+func EnrollTotp(mfaService auth.MfaService, loginService auth.LoginService, guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			CurrentPassword string `json:"current_password"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if !checkLoginGuard(guard, username, c) {
+			return
+		}
+		_, err = loginService.Login(username, request.CurrentPassword)
+		if err == auth.ErrInvalidCredentials {
+			err = guard.RegisterFailure(username, c.ClientIP())
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			wrapErrorAndSend(errors.New("incorrect current password"), http.StatusForbidden, c)
+			return
+		}
+		if err != nil {
+			if releaseLoginGuard(guard, username, c) {
+				sendLoginError(err, c)
+			}
+			return
+		}
+		if !releaseLoginGuard(guard, username, c) {
+			return
+		}
+		enrollment, err := mfaService.Enroll(username)
+		if err == auth.ErrMfaAlreadyEnabled {
+			wrapErrorAndSend(err, http.StatusConflict, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusCreated, enrollment)
+	}
+}
+
+func ConfirmTotp(mfaService auth.MfaService, tokenService auth.TokenService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		code, err := readMfaCode(c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		recoveryCodes, err := mfaService.Confirm(username, code)
+		if err != nil {
+			sendMfaError(err, c)
+			return
+		}
+		err = tokenService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+	}
+}
+
+func DisableTotp(mfaService auth.MfaService, guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		code, err := readMfaCode(c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if !checkLoginGuard(guard, username, c) {
+			return
+		}
+		err = mfaService.Disable(username, code)
+		if err == auth.ErrInvalidMfaCode {
+			registerLoginFailure(guard, username, c)
+			return
+		}
+		if err != nil {
+			sendMfaError(err, c)
+			return
+		}
+		if !releaseLoginGuard(guard, username, c) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func RegenerateRecoveryCodes(mfaService auth.MfaService, guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		code, err := readMfaCode(c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if !checkLoginGuard(guard, username, c) {
+			return
+		}
+		recoveryCodes, err := mfaService.RegenerateRecoveryCodes(username, code)
+		if err == auth.ErrInvalidMfaCode {
+			registerLoginFailure(guard, username, c)
+			return
+		}
+		if err != nil {
+			sendMfaError(err, c)
+			return
+		}
+		if !releaseLoginGuard(guard, username, c) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+	}
+}
+
+func checkLoginGuard(guard auth.LoginGuard, username string, c *gin.Context) bool {
+	retryAfter, err := guard.Check(username, c.ClientIP())
+	if err == auth.ErrLoginLocked {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		wrapErrorAndSend(err, http.StatusTooManyRequests, c)
+		return false
+	}
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return false
+	}
+	return true
+}
+
+func releaseLoginGuard(guard auth.LoginGuard, username string, c *gin.Context) bool {
+	err := guard.Release(username, c.ClientIP())
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return false
+	}
+	return true
+}
+
+func sendLoginError(err error, c *gin.Context) {
+	switch {
+	case errors.Is(err, auth.ErrLdapUnavailable):
+		log.Error(err)
+		wrapErrorAndSend(auth.ErrLdapUnavailable, http.StatusServiceUnavailable, c)
+	case err == auth.ErrFederatedUsernameTaken:
+		wrapErrorAndSend(err, http.StatusConflict, c)
+	default:
+		log.Error(err)
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+	}
+}
+
+func registerLoginFailure(guard auth.LoginGuard, username string, c *gin.Context) {
+	err := guard.RegisterFailure(username, c.ClientIP())
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return
+	}
+	wrapErrorAndSend(auth.ErrInvalidMfaCode, http.StatusUnauthorized, c)
+}
+
+func readMfaCode(c *gin.Context) (string, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	request := &struct {
+		Code string `json:"code"`
+	}{}
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		return "", err
+	}
+	return request.Code, nil
+}
+
+func sendMfaError(err error, c *gin.Context) {
+	switch err {
+	case auth.ErrInvalidMfaCode:
+		wrapErrorAndSend(err, http.StatusUnauthorized, c)
+	case auth.ErrMfaNotEnrolled:
+		wrapErrorAndSend(err, http.StatusBadRequest, c)
+	case auth.ErrMfaAlreadyEnabled:
+		wrapErrorAndSend(err, http.StatusConflict, c)
+	default:
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+	}
+}
+
+func BeginWebAuthnRegistration(repo persist.UserRepository, webAuthnService auth.WebAuthnService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		user, err := repo.FindByUsername(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		ceremony, err := webAuthnService.BeginRegistration(user)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, ceremony)
+	}
+}
+
+func FinishWebAuthnRegistration(repo persist.UserRepository, webAuthnService auth.WebAuthnService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		request, err := readWebAuthnResponse(c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		user, err := repo.FindByUsername(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		credential, err := webAuthnService.FinishRegistration(user, request.SessionId, request.Name,
+			bytes.NewReader(request.Credential))
+		if err == auth.ErrInvalidWebAuthnSession || err == auth.ErrWebAuthnVerificationFailed {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusCreated, credential)
+	}
+}
+
+func FindAllWebAuthnCredentials(webAuthnService auth.WebAuthnService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		credentials, err := webAuthnService.Credentials(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, credentials)
+	}
+}
+
+func DeleteWebAuthnCredential(webAuthnService auth.WebAuthnService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		deleted, err := webAuthnService.DeleteCredential(username, uint(id))
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if !deleted {
+			wrapErrorAndSend(errors.New("no such credential"), http.StatusNotFound, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func BeginWebAuthnLogin(webAuthnService auth.WebAuthnService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ceremony, err := webAuthnService.BeginLogin()
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, ceremony)
+	}
+}
+
+func FinishWebAuthnLogin(webAuthnService auth.WebAuthnService, tokenService auth.TokenService,
+	cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, err := readWebAuthnResponse(c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		user, err := webAuthnService.FinishLogin(request.SessionId, bytes.NewReader(request.Credential))
+		if err == auth.ErrInvalidWebAuthnSession || err == auth.ErrWebAuthnVerificationFailed ||
+			err == auth.ErrWebAuthnCloneDetected {
+			wrapErrorAndSend(err, http.StatusUnauthorized, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		pair, err := tokenService.Issue(user)
+		if err == auth.ErrEmailNotVerified {
+			wrapErrorAndSend(err, http.StatusForbidden, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusAccepted, pair, cookies, c)
+	}
+}
+
+type webAuthnResponse struct {
+	SessionId  string          `json:"session_id"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+func readWebAuthnResponse(c *gin.Context) (*webAuthnResponse, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	request := &webAuthnResponse{}
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		return nil, err
+	}
+	if request.SessionId == "" || len(request.Credential) == 0 {
+		return nil, errors.New("session_id and credential are required")
+	}
+	return request, nil
+}
+
+func CreateApiKey(repo persist.UserRepository, apiKeyService auth.ApiKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn int64    `json:"expires_in"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if request.Name == "" {
+			wrapErrorAndSend(errors.New("name is required"), http.StatusBadRequest, c)
+			return
+		}
+		user, err := repo.FindByUsername(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		key, err := apiKeyService.Create(user, request.Name, request.Scopes,
+			time.Duration(request.ExpiresIn)*time.Second)
+		if err == auth.ErrInvalidApiKeyScope || err == auth.ErrInvalidApiKeyTTL {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusCreated, key)
+	}
+}
+
+func FindAllApiKeys(apiKeyService auth.ApiKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		keys, err := apiKeyService.FindAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+func RevokeApiKey(apiKeyService auth.ApiKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		revoked, err := apiKeyService.Revoke(username, uint(id))
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if !revoked {
+			wrapErrorAndSend(errors.New("no such api key"), http.StatusNotFound, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func UnlockUser(guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.Param("username")
+		if username == "" {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		err := guard.UnlockUser(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func UnlockIp(guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.Param("ip")
+		if ip == "" {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		err := guard.UnlockIp(ip)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func RefreshToken(tokenService auth.TokenService, cookies *SessionCookieConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
-		credentials := &struct {
-			Username string
-			Password string
+		request := &struct {
+			RefreshToken string `json:"refresh_token"`
 		}{}
-		err = json.Unmarshal(body, credentials)
+		if len(body) > 0 || !cookies.Enabled {
+			err = json.Unmarshal(body, request)
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusBadRequest, c)
+				return
+			}
+		}
+		if request.RefreshToken == "" && cookies.Enabled {
+			request.RefreshToken, err = cookieRefreshToken(cookies, c)
+			if err == ErrInvalidCsrfToken {
+				wrapErrorAndSend(err, http.StatusForbidden, c)
+				return
+			}
+		}
+		if request.RefreshToken == "" {
+			wrapErrorAndSend(auth.ErrInvalidRefreshToken, http.StatusBadRequest, c)
+			return
+		}
+		pair, err := tokenService.Refresh(request.RefreshToken)
+		if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+			wrapErrorAndSend(err, http.StatusUnauthorized, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusOK, pair, cookies, c)
+	}
+}
+
+func Logout(jwtService jwt.JwtService, tokenService auth.TokenService, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := CurrentPrincipal(c)
+		if !ok {
+			wrapErrorAndSend(errors.New("context data does not contains principal"), http.StatusInternalServerError, c)
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
-		user, ok := loginService.Login(credentials.Username, credentials.Password)
+		request := &struct {
+			RefreshToken string `json:"refresh_token"`
+		}{}
+		if len(body) > 0 {
+			err = json.Unmarshal(body, request)
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusBadRequest, c)
+				return
+			}
+		}
+		err = jwtService.RevokeToken(principal.Claims)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if request.RefreshToken == "" && principal.Cookie {
+			request.RefreshToken, _ = c.Cookie(cookies.scopedCookieName(refreshCookieName))
+		}
+		if request.RefreshToken != "" {
+			err = tokenService.Revoke(principal.Username, request.RefreshToken)
+			if err != nil && err != auth.ErrInvalidRefreshToken {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+		}
+		clearSessionCookies(cookies, c)
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func LogoutEverywhere(tokenService auth.TokenService, apiKeyService auth.ApiKeyService,
+	cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
 		if !ok {
-			wrapErrorAndSend(errors.New("incorrect credentials"), http.StatusUnauthorized, c)
+			wrapErrorAndSend(errors.New("context data does not contains username"), http.StatusInternalServerError, c)
+			return
+		}
+		err := tokenService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = apiKeyService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
 			return
 		}
-		token := authTokenPrefix + jwtService.GenerateToken(user)
-		c.Data(http.StatusAccepted, "text/plain", []byte(token))
+		clearSessionCookies(cookies, c)
+		c.Status(http.StatusAccepted)
 	}
 }
 
-func SaveUser(repo persist.UserRepository, encoder auth.PasswordEncoder) gin.HandlerFunc {
+func SaveUser(repo persist.UserRepository, encoder auth.PasswordEncoder, policy auth.PasswordPolicy,
+	verificationService auth.EmailVerificationService, config *auth.EmailVerificationConfig) gin.HandlerFunc {
+	queue := make(chan persist.User, config.QueueSize)
+	for i := 0; i < config.Workers; i++ {
+		go func() {
+			for user := range queue {
+				err := verificationService.SendVerification(&user)
+				if err != nil {
+					log.Error(err)
+				}
+			}
+		}()
+	}
 	return func(c *gin.Context) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
@@ -55,6 +871,19 @@ func SaveUser(repo persist.UserRepository, encoder auth.PasswordEncoder) gin.Han
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
+		email, err := netmail.ParseAddress(user.Email)
+		if err != nil {
+			wrapErrorAndSend(errors.New("valid email is required"), http.StatusBadRequest, c)
+			return
+		}
+		user.Email = strings.ToLower(email.Address)
+		user.EmailVerified = false
+		user.Roles = nil
+		err = policy.Validate(user.Username, user.Password)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
 		pass, err := encoder.Encode(user.Password)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
@@ -66,11 +895,86 @@ func SaveUser(repo persist.UserRepository, encoder auth.PasswordEncoder) gin.Han
 			wrapErrorAndSend(err, http.StatusInternalServerError, c)
 			return
 		}
+		select {
+		case queue <- user:
+		default:
+			log.Warnf("Verification mail for %s dropped, %v", user.Username, ErrVerificationQueueFull)
+		}
 		c.JSON(http.StatusCreated, hideUserConfidentialFields(&user))
 	}
 }
 
-func UpdateUser(repo persist.UserRepository, encoder auth.PasswordEncoder) gin.HandlerFunc {
+func VerifyEmail(verificationService auth.EmailVerificationService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			Token string `json:"token"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		_, err = verificationService.Verify(request.Token)
+		if err == auth.ErrInvalidVerificationToken {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func ResendVerification(verificationService auth.EmailVerificationService,
+	config *auth.EmailVerificationConfig) gin.HandlerFunc {
+	queue := make(chan string, config.QueueSize)
+	for i := 0; i < config.Workers; i++ {
+		go func() {
+			for username := range queue {
+				err := verificationService.Resend(username)
+				if err != nil && err != auth.ErrVerificationRateLimited {
+					log.Error(err)
+				}
+			}
+		}()
+	}
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			Username string `json:"username"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if request.Username == "" {
+			wrapErrorAndSend(errors.New("username is required"), http.StatusBadRequest, c)
+			return
+		}
+		select {
+		case queue <- request.Username:
+			c.Status(http.StatusAccepted)
+		default:
+			wrapErrorAndSend(ErrVerificationQueueFull, http.StatusServiceUnavailable, c)
+		}
+	}
+}
+
+func UpdateUser(repo persist.UserRepository, loginService auth.LoginService, federatedService auth.FederatedService,
+	encoder auth.PasswordEncoder, policy auth.PasswordPolicy, tokenService auth.TokenService,
+	apiKeyService auth.ApiKeyService, guard auth.LoginGuard, cookies *SessionCookieConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		username, ok := ExtractUsernameContextData(c)
 		if !ok {
@@ -82,25 +986,179 @@ func UpdateUser(repo persist.UserRepository, encoder auth.PasswordEncoder) gin.H
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
-		var user persist.User
-		err = json.Unmarshal(body, &user)
+		request := &struct {
+			CurrentPassword string `json:"current_password"`
+			Password        string `json:"password"`
+		}{}
+		err = json.Unmarshal(body, request)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
-		user.Username = username
-		pass, err := encoder.Encode(user.Password)
+		managed, err := federatedService.ExternallyManaged(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if managed {
+			wrapErrorAndSend(auth.ErrExternallyManagedAccount, http.StatusConflict, c)
+			return
+		}
+		retryAfter, err := guard.Check(username, c.ClientIP())
+		if err == auth.ErrLoginLocked {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			wrapErrorAndSend(err, http.StatusTooManyRequests, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		_, err = loginService.Login(username, request.CurrentPassword)
+		if err == auth.ErrInvalidCredentials {
+			err = guard.RegisterFailure(username, c.ClientIP())
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			wrapErrorAndSend(errors.New("incorrect current password"), http.StatusForbidden, c)
+			return
+		}
+		if err != nil && err != auth.ErrEmailNotVerified {
+			if releaseLoginGuard(guard, username, c) {
+				sendLoginError(err, c)
+			}
+			return
+		}
+		if !releaseLoginGuard(guard, username, c) {
+			return
+		}
+		err = policy.Validate(username, request.Password)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		user, err := repo.FindByUsername(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		pass, err := encoder.Encode(request.Password)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusBadRequest, c)
 			return
 		}
 		user.Password = pass
-		err = repo.Update(&user)
+		err = repo.Update(user)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = tokenService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = apiKeyService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		pair, err := tokenService.Issue(user)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		sendTokenPair(http.StatusAccepted, pair, cookies, c)
+	}
+}
+
+func ForgotPassword(resetService auth.PasswordResetService, config *auth.PasswordResetConfig) gin.HandlerFunc {
+	queue := make(chan string, config.QueueSize)
+	for i := 0; i < config.Workers; i++ {
+		go func() {
+			for username := range queue {
+				err := resetService.RequestReset(username)
+				if err != nil {
+					log.Error(err)
+				}
+			}
+		}()
+	}
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			Username string `json:"username"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if request.Username == "" {
+			wrapErrorAndSend(errors.New("username is required"), http.StatusBadRequest, c)
+			return
+		}
+		select {
+		case queue <- request.Username:
+			c.Status(http.StatusAccepted)
+		default:
+			wrapErrorAndSend(ErrResetQueueFull, http.StatusServiceUnavailable, c)
+		}
+	}
+}
+
+func ResetPassword(resetService auth.PasswordResetService, tokenService auth.TokenService,
+	apiKeyService auth.ApiKeyService, guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		request := &struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}{}
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		user, err := resetService.ResetPassword(request.Token, request.Password)
+		if err == auth.ErrInvalidResetToken {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		var policyErr *auth.PasswordPolicyError
+		if errors.As(err, &policyErr) {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = tokenService.RevokeAll(user.Username)
 		if err != nil {
 			wrapErrorAndSend(err, http.StatusInternalServerError, c)
 			return
 		}
-		c.JSON(http.StatusAccepted, hideUserConfidentialFields(&user))
+		err = apiKeyService.RevokeAll(user.Username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		err = guard.UnlockUser(user.Username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.Status(http.StatusAccepted)
 	}
 }
 
@@ -592,7 +1650,7 @@ func AddRole(repo persist.UserRepository) gin.HandlerFunc {
 	}
 }
 
-func RemoveRole(repo persist.UserRepository) gin.HandlerFunc {
+func RemoveRole(repo persist.UserRepository, tokenService auth.TokenService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		username := c.Param("username")
 		if username == "" {
@@ -617,12 +1675,25 @@ func RemoveRole(repo persist.UserRepository) gin.HandlerFunc {
 			wrapErrorAndSend(err, http.StatusInternalServerError, c)
 			return
 		}
+		err = tokenService.RevokeAll(username)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
 		c.Status(http.StatusAccepted)
 	}
 }
 
 const confidentialFieldValue = "<secret>"
 
+func rolesToString(roles []persist.Role) []string {
+	rolesStr := make([]string, len(roles))
+	for i, role := range roles {
+		rolesStr[i] = role.Name
+	}
+	return rolesStr
+}
+
 func hideUserConfidentialFields(user *persist.User) *persist.User {
 	user.Password = confidentialFieldValue
 	return user
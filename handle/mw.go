@@ -1,8 +1,10 @@
 package handle
 
 import (
+	"crypto/subtle"
+	"errors"
+	"gin-auth/auth"
 	"gin-auth/auth/jwt"
-	jwtlib "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strings"
@@ -10,56 +12,141 @@ import (
 
 const authHeader = "Authorization"
 const authTokenPrefix = "Bearer "
-const ctxDataTokenKey = "token"
-const ctxDataClaimsKey = "claims"
-const ctxDataUsernameKey = "username"
-const ctxDataRolesKey = "roles"
+const authApiKeyPrefix = "ApiKey "
+const ctxDataPrincipalKey = "principal"
 
-func JwtAuthenticationMw(service jwt.JwtService) gin.HandlerFunc {
+type Principal struct {
+	ID       uint
+	Username string
+	Roles    []string
+	Claims   *jwt.AppClaims
+	ApiKeyId uint
+	Cookie   bool
+}
+
+func (p *Principal) ClientId() string {
+	if p.Claims == nil {
+		return ""
+	}
+	clientId, _ := p.Claims.Custom[auth.ClaimClientId].(string)
+	return clientId
+}
+
+func (p *Principal) Scopes() []string {
+	if p.Claims == nil {
+		return nil
+	}
+	scope, _ := p.Claims.Custom[auth.ClaimScope].(string)
+	return strings.Fields(scope)
+}
+
+func JwtAuthenticationMw(service jwt.JwtService, extractors ...TokenExtractor) gin.HandlerFunc {
+	return jwtAuthenticationMw(service, false, extractors)
+}
+
+func JwtAuthenticationRequiredMw(service jwt.JwtService, extractors ...TokenExtractor) gin.HandlerFunc {
+	return jwtAuthenticationMw(service, true, extractors)
+}
+
+func jwtAuthenticationMw(service jwt.JwtService, required bool, extractors []TokenExtractor) gin.HandlerFunc {
+	if len(extractors) == 0 {
+		extractors = []TokenExtractor{BearerTokenExtractor()}
+	}
 	return func(c *gin.Context) {
-		tokenHeader := c.GetHeader(authHeader)
-		if tokenHeader != "" {
-			if !strings.HasPrefix(tokenHeader, authTokenPrefix) {
+		if principal, ok := CurrentPrincipal(c); ok && principal.ApiKeyId != 0 {
+			return
+		}
+		tokenStr, extractor, err := extractToken(extractors, c)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusForbidden, c)
+			c.Abort()
+			return
+		}
+		if tokenStr == "" {
+			if required || c.GetHeader(authHeader) != "" {
 				c.Status(http.StatusUnauthorized)
 				c.Abort()
-				return
 			}
-			tokenStr := strings.TrimPrefix(tokenHeader, authTokenPrefix)
-			token, err := service.VerifyToken(tokenStr)
+			return
+		}
+		claims, err := service.VerifyToken(tokenStr)
+		if err != nil {
+			c.Status(http.StatusUnauthorized)
+			c.Abort()
+			return
+		}
+		principal := newPrincipal(claims)
+		_, principal.Cookie = extractor.(*sessionCookieTokenExtractor)
+		c.Set(ctxDataPrincipalKey, principal)
+	}
+}
+
+func ApiKeyAuthenticationMw(service auth.ApiKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyHeader := c.GetHeader(authHeader)
+		if strings.HasPrefix(keyHeader, authApiKeyPrefix) {
+			user, key, err := service.Authenticate(strings.TrimPrefix(keyHeader, authApiKeyPrefix))
 			if err != nil {
 				c.Status(http.StatusUnauthorized)
 				c.Abort()
 				return
 			}
-			c.Set(ctxDataTokenKey, token)
-			claims := token.Claims.(jwtlib.MapClaims)
-			c.Set(ctxDataClaimsKey, claims)
-			c.Set(ctxDataUsernameKey, claims[jwt.AppClaimsUsername])
-			c.Set(ctxDataRolesKey, claims[jwt.AppClaimsRoles])
+			c.Set(ctxDataPrincipalKey, &Principal{
+				ID:       user.ID,
+				Username: user.Username,
+				Roles:    rolesToString(user.Roles),
+				ApiKeyId: key.ID,
+			})
 		}
 	}
 }
 
-func JwtAuthenticationRequiredMw(service jwt.JwtService) gin.HandlerFunc {
+func ApiKeyForbiddenMw() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenHeader := c.GetHeader(authHeader)
-		if !strings.HasPrefix(tokenHeader, authTokenPrefix) {
-			c.Status(http.StatusUnauthorized)
+		if principal, ok := CurrentPrincipal(c); ok && principal.ApiKeyId != 0 {
+			wrapErrorAndSend(errors.New("api keys are not allowed for this operation"), http.StatusForbidden, c)
 			c.Abort()
+		}
+	}
+}
+
+func FirstPartyRequiredMw() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if principal, ok := CurrentPrincipal(c); ok && principal.ClientId() != "" {
+			wrapErrorAndSend(errors.New("delegated tokens are not allowed for this operation"), http.StatusForbidden, c)
+			c.Abort()
+		}
+	}
+}
+
+func ScopeRequiredMw(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := CurrentPrincipal(c)
+		if !ok {
 			return
 		}
-		tokenStr := strings.TrimPrefix(tokenHeader, authTokenPrefix)
-		token, err := service.VerifyToken(tokenStr)
-		if err != nil {
-			c.Status(http.StatusUnauthorized)
+		if principal.Username == "" {
+			wrapErrorAndSend(errors.New("client tokens cannot access user resources"), http.StatusForbidden, c)
 			c.Abort()
 			return
 		}
-		c.Set(ctxDataTokenKey, token)
-		claims := token.Claims.(jwtlib.MapClaims)
-		c.Set(ctxDataClaimsKey, claims)
-		c.Set(ctxDataUsernameKey, claims[jwt.AppClaimsUsername])
-		c.Set(ctxDataRolesKey, claims[jwt.AppClaimsRoles])
+		if principal.ClientId() != "" && !roleContainsAny(principal.Scopes(), scopes...) {
+			wrapErrorAndSend(errors.New("the access token was not granted the required scope"), http.StatusForbidden, c)
+			c.Abort()
+		}
+	}
+}
+
+func ClientCredentialsMw(clientId, clientSecret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, secret, ok := c.Request.BasicAuth()
+		if !ok || clientSecret == "" ||
+			subtle.ConstantTimeCompare([]byte(id), []byte(clientId)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(secret), []byte(clientSecret)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="introspection"`)
+			c.Status(http.StatusUnauthorized)
+			c.Abort()
+		}
 	}
 }
 
@@ -120,30 +207,36 @@ func roleContains(existingRoles []string, role string) bool {
 	return false
 }
 
-func ExtractUsernameContextData(c *gin.Context) (string, bool) {
-	usernameData, ok := c.Get(ctxDataUsernameKey)
+func CurrentPrincipal(c *gin.Context) (*Principal, bool) {
+	principalData, ok := c.Get(ctxDataPrincipalKey)
 	if !ok {
-		return "", false
+		return nil, false
 	}
-	username, ok := usernameData.(string)
-	if !ok {
+	principal, ok := principalData.(*Principal)
+	return principal, ok
+}
+
+func ExtractUsernameContextData(c *gin.Context) (string, bool) {
+	principal, ok := CurrentPrincipal(c)
+	if !ok || principal.Username == "" {
 		return "", false
 	}
-	return username, true
+	return principal.Username, true
 }
 
 func ExtractRolesContextData(c *gin.Context) ([]string, bool) {
-	rolesData, ok := c.Get(ctxDataRolesKey)
-	if !ok {
-		return nil, false
-	}
-	rolesInterface, ok := rolesData.([]interface{})
+	principal, ok := CurrentPrincipal(c)
 	if !ok {
 		return nil, false
 	}
-	roles := make([]string, len(rolesInterface))
-	for i, role := range rolesInterface {
-		roles[i] = role.(string)
+	return principal.Roles, true
+}
+
+func newPrincipal(claims *jwt.AppClaims) *Principal {
+	return &Principal{
+		ID:       claims.ID,
+		Username: claims.Username,
+		Roles:    claims.Roles,
+		Claims:   claims,
 	}
-	return roles, true
 }
@@ -0,0 +1,362 @@
+package handle
+
+import (
+	"bytes"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"gin-auth/auth"
+	"gin-auth/auth/oauth"
+	"gin-auth/persist"
+	"gin-auth/util"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+const consentDecisionApprove = "approve"
+const logoutConfirmCookieName = "gin_logout_confirm"
+const logoutConfirmTokenSize = 32
+
+//go:embed consent.html
+var consentHtml string
+
+var consentTemplate = template.Must(template.New("consent").Parse(consentHtml))
+
+//go:embed logged_out.html
+var loggedOutHtml []byte
+
+//go:embed logout_confirm.html
+var logoutConfirmHtml string
+
+var logoutConfirmTemplate = template.Must(template.New("logout_confirm").Parse(logoutConfirmHtml))
+
+type consentPage struct {
+	Client  *persist.OAuthClient
+	Scopes  []string
+	Request *oauth.AuthorizationRequest
+	Action  string
+	Error   string
+}
+
+type logoutConfirmPage struct {
+	Client  *persist.OAuthClient
+	Request *oauth.EndSessionRequest
+	Action  string
+	Confirm string
+}
+
+func RegisterOAuthClient(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := ExtractUsernameContextData(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		registration := &oauth.ClientRegistration{}
+		err = json.Unmarshal(body, registration)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		client, err := oauthService.RegisterClient(username, registration)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		c.JSON(http.StatusCreated, client)
+	}
+}
+
+func FindAllOAuthClients(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clients, err := oauthService.FindAllClients()
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, clients)
+	}
+}
+
+func DeleteOAuthClient(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deleted, err := oauthService.DeleteClient(c.Param("clientId"))
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		if !deleted {
+			wrapErrorAndSend(errors.New("no such client"), http.StatusNotFound, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func AuthorizeConsent(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := &oauth.AuthorizationRequest{}
+		err := c.ShouldBindQuery(request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		client, scopes, err := oauthService.ValidateAuthorizationRequest(request)
+		if err != nil {
+			sendAuthorizationError(request, err, c)
+			return
+		}
+		renderConsent(http.StatusOK, &consentPage{Client: client, Scopes: scopes, Request: request}, c)
+	}
+}
+
+func Authorize(oauthService oauth.Service, loginService auth.LoginService, mfaService auth.MfaService,
+	guard auth.LoginGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := &oauth.AuthorizationRequest{}
+		err := c.ShouldBind(request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		client, scopes, err := oauthService.ValidateAuthorizationRequest(request)
+		if err != nil {
+			sendAuthorizationError(request, err, c)
+			return
+		}
+		if c.PostForm("decision") != consentDecisionApprove {
+			c.Redirect(http.StatusSeeOther, oauth.ErrorRedirectUri(request,
+				&oauth.Error{Code: oauth.ErrorAccessDenied, Description: "the resource owner denied the request"}))
+			return
+		}
+		page := &consentPage{Client: client, Scopes: scopes, Request: request}
+		username := c.PostForm("username")
+		if !checkLoginGuard(guard, username, c) {
+			return
+		}
+		user, err := loginService.Login(username, c.PostForm("password"))
+		if err == nil {
+			err = verifyConsentMfa(mfaService, user, c.PostForm("code"))
+		}
+		if err == auth.ErrEmailNotVerified {
+			if releaseLoginGuard(guard, username, c) {
+				page.Error = err.Error()
+				renderConsent(http.StatusForbidden, page, c)
+			}
+			return
+		}
+		if err == auth.ErrInvalidCredentials || err == auth.ErrInvalidMfaCode {
+			err = guard.RegisterFailure(username, c.ClientIP())
+			if err != nil {
+				wrapErrorAndSend(err, http.StatusInternalServerError, c)
+				return
+			}
+			page.Error = auth.ErrInvalidCredentials.Error()
+			renderConsent(http.StatusUnauthorized, page, c)
+			return
+		}
+		if err != nil {
+			if releaseLoginGuard(guard, username, c) {
+				sendLoginError(err, c)
+			}
+			return
+		}
+		err = guard.RegisterSuccess(username, c.ClientIP())
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		redirectUri, err := oauthService.Authorize(request, user)
+		if err != nil {
+			sendAuthorizationError(request, err, c)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, redirectUri)
+	}
+}
+
+func IssueOAuthToken(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		request := &oauth.TokenRequest{}
+		err := c.ShouldBind(request)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, &oauth.Error{Code: oauth.ErrorInvalidRequest, Description: err.Error()})
+			return
+		}
+		if clientId, clientSecret, ok := c.Request.BasicAuth(); ok {
+			request.ClientId = clientId
+			request.ClientSecret = clientSecret
+		}
+		pair, err := oauthService.Token(request)
+		var oauthErr *oauth.Error
+		if errors.As(err, &oauthErr) {
+			if oauthErr.Code == oauth.ErrorInvalidClient {
+				c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+			}
+			c.JSON(oauthErr.Status, oauthErr)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.JSON(http.StatusOK, pair)
+	}
+}
+
+func OpenIdConfiguration(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, oauthService.Discovery())
+	}
+}
+
+func UserInfo(oauthService oauth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := CurrentPrincipal(c)
+		if !ok || principal.Claims == nil {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			c.JSON(http.StatusForbidden, &oauth.Error{Code: oauth.ErrorInsufficientScope})
+			return
+		}
+		info, err := oauthService.UserInfo(principal.Claims)
+		var oauthErr *oauth.Error
+		if errors.As(err, &oauthErr) {
+			c.Header("WWW-Authenticate", `Bearer error="`+oauthErr.Code+`"`)
+			c.JSON(oauthErr.Status, oauthErr)
+			return
+		}
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, info)
+	}
+}
+
+func EndSession(oauthService oauth.Service, cookies *SessionCookieConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := &oauth.EndSessionRequest{}
+		err := c.ShouldBind(request)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusBadRequest, c)
+			return
+		}
+		if c.Request.Method != http.MethodPost || !logoutConfirmed(c) {
+			client, err := oauthService.ValidateEndSession(request)
+			if err != nil {
+				sendEndSessionError(err, c)
+				return
+			}
+			renderLogoutConfirm(client, request, cookies, c)
+			return
+		}
+		setLogoutConfirmCookie(cookies, "", -1, c)
+		redirectUri, err := oauthService.EndSession(request)
+		if err != nil {
+			sendEndSessionError(err, c)
+			return
+		}
+		if redirectUri != "" {
+			c.Redirect(http.StatusSeeOther, redirectUri)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", loggedOutHtml)
+	}
+}
+
+func logoutConfirmed(c *gin.Context) bool {
+	expected, err := c.Cookie(logoutConfirmCookieName)
+	if err != nil || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.PostForm("confirm")), []byte(expected)) == 1
+}
+
+func renderLogoutConfirm(client *persist.OAuthClient, request *oauth.EndSessionRequest,
+	cookies *SessionCookieConfig, c *gin.Context) {
+	confirm, err := util.GenerateRandomToken(logoutConfirmTokenSize)
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return
+	}
+	page := &logoutConfirmPage{Client: client, Request: request, Action: c.Request.URL.Path, Confirm: confirm}
+	var buffer bytes.Buffer
+	err = logoutConfirmTemplate.Execute(&buffer, page)
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return
+	}
+	setLogoutConfirmCookie(cookies, confirm, 0, c)
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buffer.Bytes())
+}
+
+func setLogoutConfirmCookie(cookies *SessionCookieConfig, value string, maxAge int, c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     logoutConfirmCookieName,
+		Value:    value,
+		Path:     c.Request.URL.Path,
+		MaxAge:   maxAge,
+		Secure:   cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func sendEndSessionError(err error, c *gin.Context) {
+	var oauthErr *oauth.Error
+	if errors.As(err, &oauthErr) {
+		c.JSON(oauthErr.Status, oauthErr)
+		return
+	}
+	wrapErrorAndSend(err, http.StatusInternalServerError, c)
+}
+
+func verifyConsentMfa(mfaService auth.MfaService, user *persist.User, code string) error {
+	enabled, err := mfaService.Enabled(user.Username)
+	if err != nil || !enabled {
+		return err
+	}
+	return mfaService.Verify(user.Username, code)
+}
+
+func sendAuthorizationError(request *oauth.AuthorizationRequest, err error, c *gin.Context) {
+	var oauthErr *oauth.Error
+	if errors.As(err, &oauthErr) && oauthErr.Redirectable() {
+		c.Redirect(http.StatusSeeOther, oauth.ErrorRedirectUri(request, oauthErr))
+		return
+	}
+	if errors.As(err, &oauthErr) {
+		c.JSON(oauthErr.Status, oauthErr)
+		return
+	}
+	wrapErrorAndSend(err, http.StatusInternalServerError, c)
+}
+
+func renderConsent(status int, page *consentPage, c *gin.Context) {
+	page.Action = c.Request.URL.Path
+	var buffer bytes.Buffer
+	err := consentTemplate.Execute(&buffer, page)
+	if err != nil {
+		wrapErrorAndSend(err, http.StatusInternalServerError, c)
+		return
+	}
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, "text/html; charset=utf-8", buffer.Bytes())
+}
@@ -0,0 +1,142 @@
+package handle
+
+import (
+	"crypto/subtle"
+	"errors"
+	"gin-auth/auth"
+	"gin-auth/util"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const csrfHeader = "X-CSRF-Token"
+const csrfTokenSize = 32
+const hostCookiePrefix = "__Host-"
+const secureCookiePrefix = "__Secure-"
+
+const (
+	accessCookieName  = "gin_access"
+	refreshCookieName = "gin_refresh"
+	csrfCookieName    = "gin_csrf"
+)
+
+var ErrInvalidCsrfToken = errors.New("missing or invalid csrf token")
+
+type SessionCookieConfig struct {
+	Enabled      bool
+	Secure       bool
+	SameSite     http.SameSite
+	RefreshTTL   time.Duration
+	RefreshPaths []string
+}
+
+func DefaultSessionCookieConfig() *SessionCookieConfig {
+	return &SessionCookieConfig{
+		Secure:       true,
+		SameSite:     http.SameSiteStrictMode,
+		RefreshTTL:   auth.RefreshTokenTTL,
+		RefreshPaths: []string{"/token/refresh", "/logout"},
+	}
+}
+
+func (c *SessionCookieConfig) cookieName(name string) string {
+	if c.Secure {
+		return hostCookiePrefix + name
+	}
+	return name
+}
+
+func (c *SessionCookieConfig) scopedCookieName(name string) string {
+	if c.Secure {
+		return secureCookiePrefix + name
+	}
+	return name
+}
+
+type CookieSession struct {
+	CsrfToken             string `json:"csrf_token"`
+	ExpiresIn             int64  `json:"expires_in"`
+	MfaEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+}
+
+func sendTokenPair(status int, pair *auth.TokenPair, config *SessionCookieConfig, c *gin.Context) {
+	if !config.Enabled {
+		c.JSON(status, pair)
+		return
+	}
+	csrfToken, err := c.Cookie(config.cookieName(csrfCookieName))
+	if err != nil || csrfToken == "" {
+		csrfToken, err = util.GenerateRandomToken(csrfTokenSize)
+		if err != nil {
+			wrapErrorAndSend(err, http.StatusInternalServerError, c)
+			return
+		}
+	}
+	refreshMaxAge := int(config.RefreshTTL.Seconds())
+	setSessionCookie(config, accessCookieName, pair.AccessToken, int(pair.ExpiresIn), true, c)
+	setRefreshCookies(config, pair.RefreshToken, refreshMaxAge, c)
+	setSessionCookie(config, csrfCookieName, csrfToken, refreshMaxAge, false, c)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, &CookieSession{
+		CsrfToken:             csrfToken,
+		ExpiresIn:             pair.ExpiresIn,
+		MfaEnrollmentRequired: pair.MfaEnrollmentRequired,
+	})
+}
+
+func cookieRefreshToken(config *SessionCookieConfig, c *gin.Context) (string, error) {
+	token, err := c.Cookie(config.scopedCookieName(refreshCookieName))
+	if err != nil || token == "" {
+		return "", auth.ErrInvalidRefreshToken
+	}
+	if !verifyCsrf(config, c) {
+		return "", ErrInvalidCsrfToken
+	}
+	return token, nil
+}
+
+func clearSessionCookies(config *SessionCookieConfig, c *gin.Context) {
+	if !config.Enabled {
+		return
+	}
+	setSessionCookie(config, accessCookieName, "", -1, true, c)
+	setSessionCookie(config, csrfCookieName, "", -1, false, c)
+	setRefreshCookies(config, "", -1, c)
+}
+
+func setSessionCookie(config *SessionCookieConfig, name, value string, maxAge int, httpOnly bool, c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     config.cookieName(name),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   config.Secure,
+		HttpOnly: httpOnly,
+		SameSite: config.SameSite,
+	})
+}
+
+func setRefreshCookies(config *SessionCookieConfig, value string, maxAge int, c *gin.Context) {
+	for _, path := range config.RefreshPaths {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     config.scopedCookieName(refreshCookieName),
+			Value:    value,
+			Path:     path,
+			MaxAge:   maxAge,
+			Secure:   config.Secure,
+			HttpOnly: true,
+			SameSite: config.SameSite,
+		})
+	}
+}
+
+func verifyCsrf(config *SessionCookieConfig, c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	expected, err := c.Cookie(config.cookieName(csrfCookieName))
+	actual := c.GetHeader(csrfHeader)
+	return err == nil && expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
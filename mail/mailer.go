@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(message *Message) error
+}
+
+type SmtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SmtpMailer) Send(message *Message) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, formatMessage(m.from, message))
+}
+
+func NewSmtpMailer(host string, port int, username, password, from string) *SmtpMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SmtpMailer{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+		auth: auth,
+	}
+}
+
+type LogMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func (m *LogMailer) Send(message *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.w.Write(append(formatMessage(m.from, message), '\r', '\n'))
+	return err
+}
+
+func NewLogMailer(w io.Writer, from string) *LogMailer {
+	return &LogMailer{
+		w:    w,
+		from: from,
+	}
+}
+
+func formatMessage(from string, message *Message) []byte {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From: %s\r\n", sanitizeHeader(from))
+	fmt.Fprintf(&builder, "To: %s\r\n", sanitizeHeader(message.To))
+	fmt.Fprintf(&builder, "Subject: %s\r\n", sanitizeHeader(message.Subject))
+	fmt.Fprintf(&builder, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	builder.WriteString("\r\n")
+	return []byte(builder.String())
+}
+
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,152 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+type smtpDelivery struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+func startSmtpStub(t *testing.T) (string, int, <-chan *smtpDelivery) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	deliveries := make(chan *smtpDelivery, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serveSmtp(conn, deliveries)
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, deliveries
+}
+
+func serveSmtp(conn net.Conn, deliveries chan<- *smtpDelivery) {
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	delivery := &smtpDelivery{}
+	reply("220 stub ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-stub")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			delivery.auth = string(decoded)
+			reply("235 accepted")
+		case "MAIL":
+			delivery.from = line
+			reply("250 ok")
+		case "RCPT":
+			delivery.to = append(delivery.to, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			delivery.data = data.String()
+			deliveries <- delivery
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSmtpMailerSend(t *testing.T) {
+	host, port, deliveries := startSmtpStub(t)
+	mailer := NewSmtpMailer(host, port, "mailer", "secret", "gin-auth@example.com")
+
+	err := mailer.Send(&Message{
+		To:      "bob@example.com",
+		Subject: "Password reset\r\nBcc: eve@example.com",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := <-deliveries
+	if delivery.auth != "\x00mailer\x00secret" {
+		t.Errorf("auth = %q, want plain credentials", delivery.auth)
+	}
+	if !strings.HasPrefix(delivery.from, "MAIL FROM:<gin-auth@example.com>") {
+		t.Errorf("envelope sender = %q", delivery.from)
+	}
+	if len(delivery.to) != 1 || delivery.to[0] != "RCPT TO:<bob@example.com>" {
+		t.Errorf("envelope recipients = %q", delivery.to)
+	}
+	headers, body, _ := strings.Cut(delivery.data, "\r\n\r\n")
+	headers += "\r\n"
+	for _, want := range []string{
+		"From: gin-auth@example.com",
+		"To: bob@example.com",
+		"Subject: Password resetBcc: eve@example.com",
+		"Content-Type: text/plain; charset=UTF-8",
+	} {
+		if !strings.Contains(headers, want+"\r\n") {
+			t.Errorf("headers missing %q:\n%s", want, headers)
+		}
+	}
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("subject injected a header:\n%s", headers)
+	}
+	if body != "line one\r\nline two\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSmtpMailerSendRejected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("554 no service\r\n"))
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	mailer := NewSmtpMailer("127.0.0.1", port, "", "", "gin-auth@example.com")
+
+	err = mailer.Send(&Message{To: "bob@example.com", Subject: "Hello", Body: "Hi"})
+	if err == nil {
+		t.Fatalf("send succeeded against a rejecting server")
+	}
+}
@@ -4,11 +4,20 @@ import (
 	"fmt"
 	"gin-auth/auth"
 	"gin-auth/auth/jwt"
+	"gin-auth/auth/oauth"
+	"gin-auth/handle"
+	"gin-auth/mail"
 	"gin-auth/persist"
 	"gin-auth/util"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 var log = logrus.New()
@@ -16,11 +25,53 @@ var log = logrus.New()
 var userRepo = persist.NewUserSqliteRepository()
 var postRepo = persist.NewPostSqliteRepository()
 var commentRepo = persist.NewCommentSqliteRepository()
+var refreshTokenRepo = persist.NewRefreshTokenSqliteRepository()
+var loginAttemptRepo = persist.NewLoginAttemptSqliteRepository()
+var passwordResetTokenRepo = persist.NewPasswordResetTokenSqliteRepository()
+var emailVerificationTokenRepo = persist.NewEmailVerificationTokenSqliteRepository()
+var totpCredentialRepo = persist.NewTotpCredentialSqliteRepository()
+var recoveryCodeRepo = persist.NewRecoveryCodeSqliteRepository()
+var mfaChallengeRepo = persist.NewMfaChallengeSqliteRepository()
+var webAuthnCredentialRepo = persist.NewWebAuthnCredentialSqliteRepository()
+var webAuthnSessionRepo = persist.NewWebAuthnSessionSqliteRepository()
+var apiKeyRepo = persist.NewApiKeySqliteRepository()
+var oauthClientRepo = persist.NewOAuthClientSqliteRepository()
+var authorizationCodeRepo = persist.NewAuthorizationCodeSqliteRepository()
+var federatedIdentityRepo = persist.NewFederatedIdentitySqliteRepository()
+var federatedLoginSessionRepo = persist.NewFederatedLoginSessionSqliteRepository()
+var signingKeyRepo = persist.NewSigningKeySqliteRepository()
+var tokenRevocationRepo = newTokenRevocationRepository(util.GetEnvVar(tokenRevocationStoreEnv, tokenRevocationStoreDefault))
 
-var passEncoder = auth.NewBcryptPasswordEncoder()
-var loginService = auth.NewDefaultLoginService(userRepo, passEncoder)
+var passEncoder = newPassEncoder()
+var passPolicy = auth.NewDefaultPasswordPolicy(newPasswordPolicyConfig())
+var emailPolicy = newUnverifiedEmailPolicy()
+var loginService = auth.NewVerifiedEmailLoginService(newLoginService(), emailPolicy)
+var mailer = newMailer()
+var passwordResetConfig = newPasswordResetConfig()
+var passwordResetService = auth.NewDefaultPasswordResetService(userRepo, passwordResetTokenRepo,
+	passEncoder, passPolicy, mailer, passwordResetConfig)
+var emailVerificationConfig = newEmailVerificationConfig()
+var emailVerificationService = auth.NewDefaultEmailVerificationService(userRepo, emailVerificationTokenRepo,
+	mailer, emailVerificationConfig)
+var mfaService = auth.NewDefaultMfaService(userRepo, totpCredentialRepo, recoveryCodeRepo, mfaChallengeRepo,
+	newMfaConfig())
+var webAuthnService = newWebAuthnService()
+var apiKeyService = auth.NewDefaultApiKeyService(userRepo, apiKeyRepo, newApiKeyConfig())
+var loginGuard = auth.NewDefaultLoginGuard(loginAttemptRepo, newLockoutConfig())
 
-var jwtService = jwt.NewJwtService(util.GetEnvVar(jwtSecretEnv, jwtSecretDefault), jwtIssuer)
+var jwtConfig = newJwtConfig()
+var keyRing = newKeyRing()
+var jwtService = jwt.NewJwtService(keyRing, jwtConfig, tokenRevocationRepo)
+var oauthConfig = newOAuthConfig()
+var tokenService = auth.NewDefaultTokenService(jwtService, userRepo, refreshTokenRepo, emailPolicy, mfaService,
+	oauthConfig.ScopeRoles)
+var oauthService = oauth.NewDefaultService(oauthClientRepo, authorizationCodeRepo, userRepo, jwtService, tokenService,
+	oauthConfig)
+var sessionCookieConfig = newSessionCookieConfig()
+var resourceTokenExtractors = newTokenExtractors(tokenExtractorsEnv)
+var accountTokenExtractors = newAccountTokenExtractors()
+var federatedService = auth.NewDefaultFederatedService(userRepo, federatedIdentityRepo, federatedLoginSessionRepo,
+	passEncoder, tokenService, newFederatedConfig())
 
 func init() {
 	persist.InitDatabase(func(db *gorm.DB) {
@@ -31,11 +82,402 @@ func init() {
 	log.Infof("Admin username: %s, password: %s", auth.AdminUsername, auth.AdminPassword)
 }
 
+func newTokenRevocationRepository(store string) persist.TokenRevocationRepository {
+	if store == tokenRevocationStoreMemory {
+		return persist.NewTokenRevocationMemoryRepository()
+	}
+	return persist.NewTokenRevocationSqliteRepository()
+}
+
+func newJwtConfig() *jwt.Config {
+	config := jwt.DefaultConfig(util.GetEnvVar(jwtIssuerEnv, jwtIssuer))
+	config.Audience = util.GetEnvVar(jwtAudienceEnv, "")
+	config.AcceptedAudiences = util.GetListEnvVar(jwtAcceptedAudiencesEnv)
+	config.TTL = util.GetDurationEnvVar(jwtTTLEnv, config.TTL)
+	config.Leeway = util.GetDurationEnvVar(jwtLeewayEnv, config.Leeway)
+	return config
+}
+
+func newPassEncoder() auth.PasswordEncoder {
+	encoder, err := auth.NewPepperedPasswordEncoder(
+		auth.NewDelegatingPasswordEncoder(util.GetEnvVar(passwordEncoderEnv, auth.EncoderArgon2id)),
+		newPeppers(),
+		util.GetIntEnvVar(passwordPepperVersionEnv, 0),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return encoder
+}
+
+func newPeppers() map[int][]byte {
+	peppers, err := auth.ParsePeppers(util.GetListEnvVar(passwordPeppersEnv))
+	if err != nil {
+		log.Fatal(err)
+	}
+	path := util.GetEnvVar(passwordPepperFileEnv, "")
+	if path == "" {
+		return peppers
+	}
+	filePeppers, err := auth.LoadPepperFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for version, pepper := range filePeppers {
+		peppers[version] = pepper
+	}
+	return peppers
+}
+
+func newLoginService() auth.LoginService {
+	local := auth.NewDefaultLoginService(userRepo, passEncoder)
+	config := auth.DefaultLdapConfig()
+	config.Url = util.GetEnvVar(ldapUrlEnv, "")
+	if config.Url == "" {
+		return local
+	}
+	config.StartTLS = util.GetBoolEnvVar(ldapStartTLSEnv, config.StartTLS)
+	config.CACertFile = util.GetEnvVar(ldapCACertFileEnv, "")
+	config.InsecureSkipVerify = util.GetBoolEnvVar(ldapInsecureSkipVerifyEnv, false)
+	config.BindDN = util.GetEnvVar(ldapBindDNEnv, "")
+	config.BindPassword = util.GetEnvVar(ldapBindPasswordEnv, "")
+	config.UserDNTemplate = util.GetEnvVar(ldapUserDNTemplateEnv, "")
+	config.BaseDN = util.GetEnvVar(ldapBaseDNEnv, "")
+	config.UserFilter = util.GetEnvVar(ldapUserFilterEnv, config.UserFilter)
+	config.UsernameAttribute = util.GetEnvVar(ldapUsernameAttributeEnv, config.UsernameAttribute)
+	config.EmailAttribute = util.GetEnvVar(ldapEmailAttributeEnv, config.EmailAttribute)
+	config.GroupsAttribute = util.GetEnvVar(ldapGroupsAttributeEnv, config.GroupsAttribute)
+	config.GroupBaseDN = util.GetEnvVar(ldapGroupBaseDNEnv, "")
+	config.GroupFilter = util.GetEnvVar(ldapGroupFilterEnv, config.GroupFilter)
+	config.Timeout = util.GetDurationEnvVar(ldapTimeoutEnv, config.Timeout)
+	groupRoles, err := auth.ParseGroupRoleMapping(util.GetListEnvVar(ldapGroupRolesEnv))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.GroupRoles = groupRoles
+	ldapService, err := auth.NewLdapLoginService(userRepo, federatedIdentityRepo, passEncoder, tokenService, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if strings.HasPrefix(config.Url, "ldap://") && !config.StartTLS {
+		log.Warnf("LDAP passwords are sent in clear text, use an ldaps url or set %s", ldapStartTLSEnv)
+	}
+	return auth.NewChainedLoginService(local, ldapService)
+}
+
+func newPasswordPolicyConfig() *auth.PasswordPolicyConfig {
+	config := auth.DefaultPasswordPolicyConfig()
+	config.MinLength = util.GetIntEnvVar(passwordMinLengthEnv, config.MinLength)
+	config.MaxBytes = util.GetIntEnvVar(passwordMaxBytesEnv, config.MaxBytes)
+	config.MinCharClasses = util.GetIntEnvVar(passwordMinCharClassesEnv, config.MinCharClasses)
+	config.MinUsernameLength = util.GetIntEnvVar(passwordMinUsernameLengthEnv, config.MinUsernameLength)
+	path := util.GetEnvVar(passwordCommonListFileEnv, "")
+	if path != "" {
+		commonList, err := auth.LoadCommonPasswordFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.CommonList = commonList
+	}
+	return config
+}
+
+func newMailer() mail.Mailer {
+	from := util.GetEnvVar(mailFromEnv, mailFromDefault)
+	switch util.GetEnvVar(mailerEnv, mailerLog) {
+	case mailerSmtp:
+		return mail.NewSmtpMailer(
+			util.GetEnvVar(smtpHostEnv, smtpHostDefault),
+			util.GetIntEnvVar(smtpPortEnv, smtpPortDefault),
+			util.GetEnvVar(smtpUsernameEnv, ""),
+			util.GetEnvVar(smtpPasswordEnv, ""),
+			from,
+		)
+	case mailerFile:
+		file, err := os.OpenFile(util.GetEnvVar(mailFileEnv, mailFileDefault), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return mail.NewLogMailer(file, from)
+	default:
+		return mail.NewLogMailer(log.Writer(), from)
+	}
+}
+
+func newPasswordResetConfig() *auth.PasswordResetConfig {
+	config := auth.DefaultPasswordResetConfig()
+	config.TTL = util.GetDurationEnvVar(passwordResetTTLEnv, config.TTL)
+	config.ResetUrl = util.GetEnvVar(passwordResetUrlEnv, config.ResetUrl)
+	config.Workers = util.GetIntEnvVar(passwordResetWorkersEnv, config.Workers)
+	config.QueueSize = util.GetIntEnvVar(passwordResetQueueSizeEnv, config.QueueSize)
+	return config
+}
+
+func newUnverifiedEmailPolicy() auth.UnverifiedEmailPolicy {
+	policy := util.GetEnvVar(unverifiedEmailPolicyEnv, auth.UnverifiedEmailAllow)
+	switch policy {
+	case auth.UnverifiedEmailAllow, auth.UnverifiedEmailDeny, auth.UnverifiedEmailAnonymous:
+		return auth.UnverifiedEmailPolicy(policy)
+	default:
+		log.Fatalf("unknown unverified email policy: %s", policy)
+		return ""
+	}
+}
+
+func newEmailVerificationConfig() *auth.EmailVerificationConfig {
+	config := auth.DefaultEmailVerificationConfig()
+	config.TTL = util.GetDurationEnvVar(emailVerificationTTLEnv, config.TTL)
+	config.VerifyUrl = util.GetEnvVar(emailVerificationUrlEnv, config.VerifyUrl)
+	config.ResendCooldown = util.GetDurationEnvVar(emailVerificationCooldownEnv, config.ResendCooldown)
+	config.Workers = util.GetIntEnvVar(emailVerificationWorkersEnv, config.Workers)
+	config.QueueSize = util.GetIntEnvVar(emailVerificationQueueSizeEnv, config.QueueSize)
+	return config
+}
+
+func newMfaConfig() *auth.MfaConfig {
+	config := auth.DefaultMfaConfig()
+	config.Issuer = util.GetEnvVar(mfaIssuerEnv, config.Issuer)
+	config.RequiredRoles = util.GetListEnvVar(mfaRequiredRolesEnv)
+	return config
+}
+
+func newWebAuthnService() auth.WebAuthnService {
+	config := auth.DefaultWebAuthnConfig()
+	config.RPID = util.GetEnvVar(webAuthnRPIDEnv, config.RPID)
+	config.RPDisplayName = util.GetEnvVar(webAuthnRPDisplayNameEnv, config.RPDisplayName)
+	if origins := util.GetListEnvVar(webAuthnRPOriginsEnv); len(origins) > 0 {
+		config.RPOrigins = origins
+	}
+	service, err := auth.NewDefaultWebAuthnService(userRepo, webAuthnCredentialRepo, webAuthnSessionRepo, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return service
+}
+
+func newApiKeyConfig() *auth.ApiKeyConfig {
+	config := auth.DefaultApiKeyConfig()
+	config.DefaultTTL = util.GetDurationEnvVar(apiKeyDefaultTTLEnv, config.DefaultTTL)
+	config.MaxTTL = util.GetDurationEnvVar(apiKeyMaxTTLEnv, config.MaxTTL)
+	return config
+}
+
+func newOAuthConfig() *oauth.Config {
+	config := oauth.DefaultConfig(jwtConfig.Issuer)
+	config.CodeTTL = util.GetDurationEnvVar(oauthCodeTTLEnv, config.CodeTTL)
+	config.IdTokenHintMaxAge = util.GetDurationEnvVar(oauthIdTokenHintMaxAgeEnv, config.IdTokenHintMaxAge)
+	if entries := util.GetListEnvVar(oauthScopeRolesEnv); len(entries) > 0 {
+		scopeRoles, err := auth.ParseScopeRoleMapping(entries)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.ScopeRoles = scopeRoles
+	}
+	return config
+}
+
+func newFederatedConfig() *auth.FederatedConfig {
+	config := auth.DefaultFederatedConfig()
+	config.SessionTTL = util.GetDurationEnvVar(federatedSessionTTLEnv, config.SessionTTL)
+	for _, name := range util.GetListEnvVar(federatedProvidersEnv) {
+		provider := auth.DefaultFederatedProviderConfig(name)
+		prefix := federatedProviderEnvPrefix + strings.ToUpper(name)
+		provider.Issuer = util.GetEnvVar(prefix+federatedIssuerEnvSuffix, "")
+		provider.ClientId = util.GetEnvVar(prefix+federatedClientIdEnvSuffix, "")
+		provider.ClientSecret = util.GetEnvVar(prefix+federatedClientSecretEnvSuffix, "")
+		provider.RedirectUrl = util.GetEnvVar(prefix+federatedRedirectUrlEnvSuffix, "")
+		if provider.Issuer == "" || provider.ClientId == "" || provider.RedirectUrl == "" {
+			log.Fatalf("identity provider %s requires %s, %s and %s", name, prefix+federatedIssuerEnvSuffix,
+				prefix+federatedClientIdEnvSuffix, prefix+federatedRedirectUrlEnvSuffix)
+		}
+		if scopes := util.GetListEnvVar(prefix + federatedScopesEnvSuffix); len(scopes) > 0 {
+			provider.Scopes = scopes
+		}
+		provider.UsernameClaim = util.GetEnvVar(prefix+federatedUsernameClaimEnvSuffix, provider.UsernameClaim)
+		provider.GroupsClaim = util.GetEnvVar(prefix+federatedGroupsClaimEnvSuffix, provider.GroupsClaim)
+		groupRoles, err := auth.ParseGroupRoleMapping(util.GetListEnvVar(prefix + federatedGroupRolesEnvSuffix))
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider.GroupRoles = groupRoles
+		provider.AutoProvision = util.GetBoolEnvVar(prefix+federatedAutoProvisionEnvSuffix, provider.AutoProvision)
+		provider.LinkVerifiedEmail = util.GetBoolEnvVar(prefix+federatedLinkVerifiedEmailEnvSuffix,
+			provider.LinkVerifiedEmail)
+		config.Providers = append(config.Providers, provider)
+	}
+	return config
+}
+
+func newSessionCookieConfig() *handle.SessionCookieConfig {
+	config := handle.DefaultSessionCookieConfig()
+	mode := util.GetEnvVar(sessionModeEnv, sessionModeBearer)
+	switch mode {
+	case sessionModeBearer:
+	case sessionModeCookie:
+		config.Enabled = true
+	default:
+		log.Fatalf("unknown session mode: %s", mode)
+	}
+	config.Secure = util.GetBoolEnvVar(sessionCookieSecureEnv, config.Secure)
+	sameSite := util.GetEnvVar(sessionCookieSameSiteEnv, "strict")
+	switch strings.ToLower(sameSite) {
+	case "strict":
+		config.SameSite = http.SameSiteStrictMode
+	case "lax":
+		config.SameSite = http.SameSiteLaxMode
+	case "none":
+		config.SameSite = http.SameSiteNoneMode
+	default:
+		log.Fatalf("unknown session cookie same site mode: %s", sameSite)
+	}
+	if config.SameSite == http.SameSiteNoneMode && !config.Secure {
+		log.Fatalf("%s=none requires secure session cookies", sessionCookieSameSiteEnv)
+	}
+	if config.Enabled && !config.Secure {
+		log.Warnf("Session cookies are sent over plain HTTP, unset %s outside of development", sessionCookieSecureEnv)
+	}
+	return config
+}
+
+func newAccountTokenExtractors() []handle.TokenExtractor {
+	for _, name := range util.GetListEnvVar(accountTokenExtractorsEnv) {
+		if name == tokenExtractorQuery {
+			log.Fatalf("%s cannot include the %s token extractor", accountTokenExtractorsEnv, tokenExtractorQuery)
+		}
+	}
+	return newTokenExtractors(accountTokenExtractorsEnv)
+}
+
+func newTokenExtractors(env string) []handle.TokenExtractor {
+	names := util.GetListEnvVar(env)
+	if len(names) == 0 {
+		names = []string{tokenExtractorBearer}
+		if sessionCookieConfig.Enabled {
+			names = append(names, tokenExtractorCookie)
+		}
+	}
+	var extractors []handle.TokenExtractor
+	for _, name := range names {
+		switch name {
+		case tokenExtractorBearer:
+			extractors = append(extractors, handle.BearerTokenExtractor())
+		case tokenExtractorHeader:
+			extractors = append(extractors, handle.HeaderTokenExtractor(
+				util.GetEnvVar(tokenHeaderEnv, tokenHeaderDefault),
+				util.GetEnvVar(tokenHeaderPrefixEnv, ""),
+			))
+		case tokenExtractorCookie:
+			if !sessionCookieConfig.Enabled {
+				log.Fatalf("%s token extractor requires %s=%s", tokenExtractorCookie, sessionModeEnv, sessionModeCookie)
+			}
+			extractors = append(extractors, handle.SessionCookieTokenExtractor(sessionCookieConfig))
+		case tokenExtractorQuery:
+			extractors = append(extractors, handle.WebSocketQueryTokenExtractor(
+				util.GetEnvVar(tokenQueryParamEnv, tokenQueryParamDefault),
+			))
+		default:
+			log.Fatalf("unknown token extractor: %s", name)
+		}
+	}
+	return extractors
+}
+
+func newLockoutConfig() *auth.LockoutConfig {
+	config := auth.DefaultLockoutConfig()
+	config.MaxUserFailures = util.GetIntEnvVar(loginMaxUserFailuresEnv, config.MaxUserFailures)
+	config.MaxIpFailures = util.GetIntEnvVar(loginMaxIpFailuresEnv, config.MaxIpFailures)
+	config.LockoutDuration = util.GetDurationEnvVar(loginLockoutDurationEnv, config.LockoutDuration)
+	config.BaseDelay = util.GetDurationEnvVar(loginBaseDelayEnv, config.BaseDelay)
+	config.MaxDelay = util.GetDurationEnvVar(loginMaxDelayEnv, config.MaxDelay)
+	config.FailureWindow = util.GetDurationEnvVar(loginFailureWindowEnv, config.FailureWindow)
+	return config
+}
+
+func newKeyRing() *jwt.KeyRing {
+	secret := util.GetEnvVar(jwtKeyEncryptionKeyEnv, "")
+	if secret == "" {
+		log.Fatalf("%s is required to encrypt rotated signing keys", jwtKeyEncryptionKeyEnv)
+	}
+	store, err := jwt.NewKeyStore(signingKeyRepo, secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ring, err := jwt.NewPersistentKeyRing(store, newSigningKey(), jwtConfig.MaxTokenLifetime(), newVerificationKeys()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ring
+}
+
+func newSigningKey() *jwt.SigningKey {
+	path := util.GetEnvVar(jwtSigningKeyFileEnv, "")
+	if path == "" {
+		return jwt.NewHmacSigningKey(util.GetEnvVar(jwtSecretEnv, jwtSecretDefault))
+	}
+	key, err := jwt.LoadSigningKey(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+func newVerificationKeys() []*jwt.SigningKey {
+	var keys []*jwt.SigningKey
+	for _, path := range util.GetListEnvVar(jwtVerificationKeyFilesEnv) {
+		key, err := jwt.LoadVerificationKey(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func startKeyRotation() {
+	interval := util.GetDurationEnvVar(jwtKeyRotationIntervalEnv, 0)
+	if interval > 0 {
+		keyRing.StartRotation(interval, func(err error) {
+			log.Error(err)
+		})
+		log.Infof("Signing keys rotate every %s", interval)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			kid, err := jwtService.RotateKeys()
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			log.Infof("Signing key rotated, kid: %s", kid)
+		}
+	}()
+}
+
+func checkOidcConfig() {
+	issuer, err := url.Parse(jwtConfig.Issuer)
+	if err != nil || !issuer.IsAbs() {
+		log.Warnf("Issuer %q is not a URL, OpenID Connect clients will reject discovery, set %s", jwtConfig.Issuer,
+			jwtIssuerEnv)
+	}
+	if strings.HasPrefix(jwtService.SigningAlgorithm(), "HS") {
+		log.Warnf("ID tokens are signed with a shared secret, OpenID Connect clients cannot verify them, set %s",
+			jwtSigningKeyFileEnv)
+	}
+}
+
 func main() {
+	checkOidcConfig()
+	startKeyRotation()
 	r := gin.Default()
+	err := r.SetTrustedProxies(util.GetListEnvVar(trustedProxiesEnv))
+	if err != nil {
+		log.Fatal(err)
+	}
 	port := util.GetIntEnvVar(serverPortEnv, serverDefaultPort)
 	routeHandlerFuncs(r)
-	err := r.Run(fmt.Sprintf(":%d", port))
+	err = r.Run(fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Error(err)
 	}
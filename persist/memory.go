@@ -0,0 +1,52 @@
+package persist
+
+import (
+	"sync"
+	"time"
+)
+
+type TokenRevocationMemoryRepository struct {
+	mu            sync.RWMutex
+	revoked       map[string]time.Time
+	revokedBefore map[string]time.Time
+}
+
+func (repo *TokenRevocationMemoryRepository) Revoke(jti string, expiresAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	now := time.Now()
+	for revokedJti, revokedExpiresAt := range repo.revoked {
+		if revokedExpiresAt.Before(now) {
+			delete(repo.revoked, revokedJti)
+		}
+	}
+	repo.revoked[jti] = expiresAt
+	return nil
+}
+
+func (repo *TokenRevocationMemoryRepository) IsRevoked(jti string) (bool, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	_, ok := repo.revoked[jti]
+	return ok, nil
+}
+
+func (repo *TokenRevocationMemoryRepository) RevokeAllBefore(username string, before time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.revokedBefore[username] = before.Truncate(time.Millisecond)
+	return nil
+}
+
+func (repo *TokenRevocationMemoryRepository) RevokedBefore(username string) (time.Time, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.revokedBefore[username], nil
+}
+
+func NewTokenRevocationMemoryRepository() *TokenRevocationMemoryRepository {
+	return &TokenRevocationMemoryRepository{
+		revoked:       make(map[string]time.Time),
+		revokedBefore: make(map[string]time.Time),
+	}
+}
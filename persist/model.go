@@ -1,14 +1,19 @@
 package persist
 
-import "gorm.io/gorm"
+import (
+	"gorm.io/gorm"
+	"time"
+)
 
 type User struct {
 	gorm.Model
-	Username string    `json:"username" gorm:"unique;not null"`
-	Password string    `json:"password" gorm:"size:256;not null"`
-	Roles    []Role    `json:"roles" gorm:"many2many:user_role_join"`
-	Posts    []Post    `json:"posts,omitempty" gorm:"foreignKey:OwnerRefer;references:Username"`
-	Comments []Comment `json:"comments,omitempty" gorm:"foreignKey:OwnerRefer;references:Username"`
+	Username      string    `json:"username" gorm:"unique;not null"`
+	Password      string    `json:"password" gorm:"size:256;not null"`
+	Email         string    `json:"email" gorm:"uniqueIndex;default:null"`
+	EmailVerified bool      `json:"email_verified"`
+	Roles         []Role    `json:"roles" gorm:"many2many:user_role_join"`
+	Posts         []Post    `json:"posts,omitempty" gorm:"foreignKey:OwnerRefer;references:Username"`
+	Comments      []Comment `json:"comments,omitempty" gorm:"foreignKey:OwnerRefer;references:Username"`
 }
 
 type Role struct {
@@ -29,3 +34,169 @@ type Comment struct {
 	OwnerRefer string `json:"owner_id"`
 	PostRefer  uint   `json:"post_id"`
 }
+
+type RefreshToken struct {
+	gorm.Model
+	TokenHash  string `gorm:"unique;not null"`
+	Family     string `gorm:"index;not null"`
+	OwnerRefer string `gorm:"index;not null"`
+	ClientId   string `gorm:"index"`
+	Scopes     string
+	ExpiresAt  time.Time `gorm:"not null"`
+	Used       bool
+	Revoked    bool
+}
+
+type RevokedToken struct {
+	gorm.Model
+	Jti       string    `gorm:"unique;not null"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+type TokenRevocation struct {
+	gorm.Model
+	Username      string `gorm:"unique;not null"`
+	RevokedBefore int64  `gorm:"not null"`
+}
+
+type SigningKey struct {
+	gorm.Model
+	Kid        string `gorm:"unique;not null"`
+	Algorithm  string
+	PrivateKey []byte
+	Current    bool
+	RetireAt   *time.Time
+}
+
+type LoginAttempt struct {
+	gorm.Model
+	Key         string `gorm:"unique;not null"`
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type PasswordResetToken struct {
+	gorm.Model
+	TokenHash  string    `gorm:"unique;not null"`
+	OwnerRefer string    `gorm:"index;not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	Used       bool
+}
+
+type EmailVerificationToken struct {
+	gorm.Model
+	TokenHash  string    `gorm:"unique;not null"`
+	OwnerRefer string    `gorm:"index;not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	Used       bool
+}
+
+type TotpCredential struct {
+	gorm.Model
+	OwnerRefer string `gorm:"unique;not null"`
+	Secret     string `gorm:"not null"`
+	Confirmed  bool
+	LastStep   int64
+}
+
+type RecoveryCode struct {
+	gorm.Model
+	CodeHash   string `gorm:"index;not null"`
+	OwnerRefer string `gorm:"index;not null"`
+	Used       bool
+}
+
+type MfaChallenge struct {
+	gorm.Model
+	TokenHash  string    `gorm:"unique;not null"`
+	OwnerRefer string    `gorm:"index;not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	Attempts   int
+	Used       bool
+}
+
+type WebAuthnCredential struct {
+	gorm.Model
+	OwnerRefer      string     `json:"-" gorm:"index;not null"`
+	Name            string     `json:"name"`
+	CredentialId    []byte     `json:"-" gorm:"uniqueIndex;not null"`
+	PublicKey       []byte     `json:"-" gorm:"not null"`
+	AttestationType string     `json:"attestation_type"`
+	Transports      string     `json:"transports"`
+	Aaguid          []byte     `json:"-"`
+	SignCount       uint32     `json:"sign_count"`
+	CloneWarning    bool       `json:"clone_warning"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+type WebAuthnSession struct {
+	gorm.Model
+	TokenHash  string    `gorm:"unique;not null"`
+	OwnerRefer string    `gorm:"index"`
+	Ceremony   string    `gorm:"not null"`
+	Data       string    `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	Used       bool
+}
+
+type ApiKey struct {
+	gorm.Model
+	OwnerRefer string     `json:"-" gorm:"index;not null"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix" gorm:"uniqueIndex;not null"`
+	KeyHash    string     `json:"-" gorm:"not null"`
+	Scopes     string     `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Revoked    bool       `json:"revoked"`
+}
+
+type OAuthClient struct {
+	gorm.Model
+	ClientId               string `json:"client_id" gorm:"uniqueIndex;not null"`
+	SecretHash             string `json:"-"`
+	Name                   string `json:"name" gorm:"not null"`
+	RedirectUris           string `json:"redirect_uris"`
+	Scopes                 string `json:"scopes"`
+	GrantTypes             string `json:"grant_types"`
+	OwnerRefer             string `json:"owner"`
+	PostLogoutRedirectUris string `json:"post_logout_redirect_uris"`
+}
+
+type AuthorizationCode struct {
+	gorm.Model
+	CodeHash            string `gorm:"unique;not null"`
+	ClientId            string `gorm:"index;not null"`
+	OwnerRefer          string `gorm:"not null"`
+	RedirectUri         string `gorm:"not null"`
+	Scopes              string
+	CodeChallenge       string    `gorm:"not null"`
+	CodeChallengeMethod string    `gorm:"not null"`
+	ExpiresAt           time.Time `gorm:"not null"`
+	Used                bool
+	Nonce               string
+	AuthTime            time.Time
+}
+
+type FederatedIdentity struct {
+	gorm.Model
+	Provider    string `json:"provider" gorm:"uniqueIndex:idx_federated_identity;not null"`
+	Subject     string `json:"subject" gorm:"uniqueIndex:idx_federated_identity;not null"`
+	Email       string `json:"email"`
+	Provisioned bool   `json:"provisioned"`
+	OwnerRefer  string `json:"-" gorm:"index;not null"`
+}
+
+type FederatedLoginSession struct {
+	gorm.Model
+	StateHash      string    `gorm:"unique;not null"`
+	Provider       string    `gorm:"not null"`
+	Nonce          string    `gorm:"not null"`
+	CodeVerifier   string    `gorm:"not null"`
+	ExpiresAt      time.Time `gorm:"not null"`
+	Used           bool
+	LinkOwnerRefer string
+}
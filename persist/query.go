@@ -1,19 +1,9 @@
 package persist
 
-import "fmt"
-
 const insertUserRoleQuery = "INSERT OR IGNORE INTO user_role_join (user_id, role_id) " +
-	"SELECT id as user_id, (SELECT id FROM roles WHERE name = '%s') AS role_id FROM USERS " +
-	"WHERE username = '%s'"
+	"SELECT id as user_id, (SELECT id FROM roles WHERE name = ?) AS role_id FROM USERS " +
+	"WHERE username = ?"
 
 const deleteUserRoleQuery = "DELETE FROM user_role_join " +
-	"WHERE role_id = (SELECT id FROM roles WHERE name = '%s') " +
-	"AND user_id = (SELECT id FROM users WHERE username = '%s')"
-
-func generateInsertUserRoleQuery(username, role string) string {
-	return fmt.Sprintf(insertUserRoleQuery, role, username)
-}
-
-func generateDeleteUserRoleQuery(username, role string) string {
-	return fmt.Sprintf(deleteUserRoleQuery, role, username)
-}
+	"WHERE role_id = (SELECT id FROM roles WHERE name = ?) " +
+	"AND user_id = (SELECT id FROM users WHERE username = ?)"
@@ -1,9 +1,14 @@
 package persist
 
+import "time"
+
 type UserRepository interface {
 	Save(user *User) error
 	Update(user *User) error
+	UpdatePasswordIfMatch(username, oldHash, newHash string) (bool, error)
 	FindByUsername(username string) (*User, error)
+	FindByEmail(email string) (*User, error)
+	MarkEmailVerified(username string) error
 	AddRole(username, role string) error
 	RemoveRole(username, role string) error
 }
@@ -23,3 +28,118 @@ type CommentRepository interface {
 	FindAllByOwnerUsername(ownerUsername string) ([]*Comment, error)
 	Delete(id uint) error
 }
+
+type RefreshTokenRepository interface {
+	Save(token *RefreshToken) error
+	FindByHash(hash string) (*RefreshToken, error)
+	MarkUsed(id uint) (bool, error)
+	RevokeFamily(family string) error
+	RevokeAllByOwnerUsername(ownerUsername string) error
+	RevokeAllByOwnerUsernameAndClientId(ownerUsername, clientId string) error
+}
+
+type SigningKeyRepository interface {
+	FindAll() ([]*SigningKey, error)
+	Rotate(key *SigningKey, retiringKid string, retireAt time.Time) error
+	Reinstate(kid, retiringKid string, retireAt time.Time) error
+}
+
+type TokenRevocationRepository interface {
+	Revoke(jti string, expiresAt time.Time) error
+	IsRevoked(jti string) (bool, error)
+	RevokeAllBefore(username string, before time.Time) error
+	RevokedBefore(username string) (time.Time, error)
+}
+
+type LoginAttemptRepository interface {
+	Find(key string) (*LoginAttempt, error)
+	Increment(key string, windowStart time.Time) (*LoginAttempt, error)
+	Decrement(key string) error
+	RecordFailure(key string, at time.Time) (*LoginAttempt, error)
+	Lock(key string, until time.Time) error
+	Delete(key string) error
+}
+
+type PasswordResetTokenRepository interface {
+	Save(token *PasswordResetToken) error
+	FindByHash(hash string) (*PasswordResetToken, error)
+	MarkUsed(id uint) (bool, error)
+	DeleteAllByOwnerUsername(ownerUsername string) error
+}
+
+type EmailVerificationTokenRepository interface {
+	Save(token *EmailVerificationToken) error
+	FindByHash(hash string) (*EmailVerificationToken, error)
+	MarkUsed(id uint) (bool, error)
+	CountCreatedSince(ownerUsername string, since time.Time) (int64, error)
+}
+
+type TotpCredentialRepository interface {
+	Save(credential *TotpCredential) error
+	FindByOwnerUsername(ownerUsername string) (*TotpCredential, error)
+	Confirm(ownerUsername string) error
+	UpdateLastStep(ownerUsername string, step int64) (bool, error)
+	DeleteByOwnerUsername(ownerUsername string) error
+}
+
+type RecoveryCodeRepository interface {
+	ReplaceAll(ownerUsername string, codes []RecoveryCode) error
+	MarkUsed(ownerUsername, hash string) (bool, error)
+	DeleteAllByOwnerUsername(ownerUsername string) error
+}
+
+type MfaChallengeRepository interface {
+	Save(challenge *MfaChallenge) error
+	FindByHash(hash string) (*MfaChallenge, error)
+	IncrementAttempts(id uint) error
+	MarkUsed(id uint) (bool, error)
+}
+
+type WebAuthnCredentialRepository interface {
+	Save(credential *WebAuthnCredential) error
+	FindAllByOwnerUsername(ownerUsername string) ([]*WebAuthnCredential, error)
+	FindByCredentialId(credentialId []byte) (*WebAuthnCredential, error)
+	UpdateUsage(credential *WebAuthnCredential) error
+	Delete(ownerUsername string, id uint) (bool, error)
+}
+
+type WebAuthnSessionRepository interface {
+	Save(session *WebAuthnSession) error
+	FindByHash(hash string) (*WebAuthnSession, error)
+	MarkUsed(id uint) (bool, error)
+}
+
+type ApiKeyRepository interface {
+	Save(key *ApiKey) error
+	FindByPrefix(prefix string) (*ApiKey, error)
+	FindAllByOwnerUsername(ownerUsername string) ([]*ApiKey, error)
+	UpdateLastUsed(id uint, lastUsedAt time.Time) error
+	Revoke(ownerUsername string, id uint) (bool, error)
+	RevokeAllByOwnerUsername(ownerUsername string) error
+}
+
+type OAuthClientRepository interface {
+	Save(client *OAuthClient) error
+	FindByClientId(clientId string) (*OAuthClient, error)
+	FindAll() ([]*OAuthClient, error)
+	Delete(clientId string) (bool, error)
+}
+
+type AuthorizationCodeRepository interface {
+	Save(code *AuthorizationCode) error
+	FindByHash(hash string) (*AuthorizationCode, error)
+	MarkUsed(id uint) (bool, error)
+}
+
+type FederatedIdentityRepository interface {
+	Save(identity *FederatedIdentity) error
+	Find(provider, subject string) (*FederatedIdentity, error)
+	FindAllByOwnerUsername(ownerUsername string) ([]*FederatedIdentity, error)
+	Delete(ownerUsername string, id uint) (bool, error)
+}
+
+type FederatedLoginSessionRepository interface {
+	Save(session *FederatedLoginSession) error
+	FindByHash(hash string) (*FederatedLoginSession, error)
+	MarkUsed(id uint) (bool, error)
+}
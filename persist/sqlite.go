@@ -4,6 +4,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
 )
 
 const dbName = "test.db"
@@ -24,10 +26,24 @@ func InitDatabase(callback func(db *gorm.DB)) *gorm.DB {
 	}
 	log.Infoln("Database created successfully")
 	db = newDb
-	err = db.AutoMigrate(&User{}, &Role{}, &Post{}, &Comment{})
+	backfillEmailVerified := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "EmailVerified")
+	err = db.AutoMigrate(&User{}, &Role{}, &Post{}, &Comment{},
+		&RefreshToken{}, &RevokedToken{}, &TokenRevocation{}, &SigningKey{}, &LoginAttempt{},
+		&PasswordResetToken{}, &EmailVerificationToken{}, &TotpCredential{}, &RecoveryCode{},
+		&MfaChallenge{}, &WebAuthnCredential{}, &WebAuthnSession{}, &ApiKey{},
+		&OAuthClient{}, &AuthorizationCode{}, &FederatedIdentity{}, &FederatedLoginSession{})
 	if err != nil {
 		log.Error(err)
 	}
+	if backfillEmailVerified {
+		err = db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Model(&User{}).
+			Update("email_verified", true).
+			Error
+		if err != nil {
+			log.Error(err)
+		}
+		log.Infoln("Marked existing user emails as verified")
+	}
 	log.Infoln("Database schema is ready")
 	if callback != nil {
 		callback(db)
@@ -50,24 +66,44 @@ func (repo *UserSqliteRepository) Save(user *User) error {
 }
 
 func (repo *UserSqliteRepository) Update(user *User) error {
-	return repo.db.Model(user).
-		Updates(map[string]interface{}{"password": user.Password}).
+	return repo.db.Model(&User{}).
 		Where("username = ?", user.Username).
+		Updates(map[string]interface{}{"password": user.Password}).
 		Error
 }
 
+func (repo *UserSqliteRepository) UpdatePasswordIfMatch(username, oldHash, newHash string) (bool, error) {
+	result := repo.db.Model(&User{}).
+		Where("username = ? AND password = ?", username, oldHash).
+		Update("password", newHash)
+	return result.RowsAffected > 0, result.Error
+}
+
 func (repo *UserSqliteRepository) FindByUsername(username string) (*User, error) {
 	user := new(User)
 	err := repo.db.Preload("Roles").First(user, "username = ?", username).Error
 	return user, err
 }
 
+func (repo *UserSqliteRepository) FindByEmail(email string) (*User, error) {
+	user := new(User)
+	err := repo.db.Preload("Roles").First(user, "email = ?", email).Error
+	return user, err
+}
+
+func (repo *UserSqliteRepository) MarkEmailVerified(username string) error {
+	return repo.db.Model(&User{}).
+		Where("username = ?", username).
+		Update("email_verified", true).
+		Error
+}
+
 func (repo *UserSqliteRepository) AddRole(username, role string) error {
-	return repo.db.Exec(generateInsertUserRoleQuery(username, role)).Error
+	return repo.db.Exec(insertUserRoleQuery, role, username).Error
 }
 
 func (repo *UserSqliteRepository) RemoveRole(username, role string) error {
-	return repo.db.Exec(generateDeleteUserRoleQuery(username, role)).Error
+	return repo.db.Exec(deleteUserRoleQuery, role, username).Error
 }
 
 type PostSqliteRepository struct {
@@ -145,3 +181,639 @@ func NewCommentSqliteRepository() *CommentSqliteRepository {
 		db: InitDatabase(nil),
 	}
 }
+
+type RefreshTokenSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *RefreshTokenSqliteRepository) Save(token *RefreshToken) error {
+	return repo.db.Create(token).Error
+}
+
+func (repo *RefreshTokenSqliteRepository) FindByHash(hash string) (*RefreshToken, error) {
+	token := new(RefreshToken)
+	err := repo.db.First(token, "token_hash = ?", hash).Error
+	return token, err
+}
+
+func (repo *RefreshTokenSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&RefreshToken{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (repo *RefreshTokenSqliteRepository) RevokeFamily(family string) error {
+	return repo.db.Model(&RefreshToken{}).
+		Where("family = ?", family).
+		Update("revoked", true).
+		Error
+}
+
+func (repo *RefreshTokenSqliteRepository) RevokeAllByOwnerUsername(ownerUsername string) error {
+	return repo.db.Model(&RefreshToken{}).
+		Where("owner_refer = ?", ownerUsername).
+		Update("revoked", true).
+		Error
+}
+
+func (repo *RefreshTokenSqliteRepository) RevokeAllByOwnerUsernameAndClientId(ownerUsername, clientId string) error {
+	return repo.db.Model(&RefreshToken{}).
+		Where("owner_refer = ? AND client_id = ?", ownerUsername, clientId).
+		Update("revoked", true).
+		Error
+}
+
+func NewRefreshTokenSqliteRepository() *RefreshTokenSqliteRepository {
+	return &RefreshTokenSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type SigningKeySqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *SigningKeySqliteRepository) FindAll() ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := repo.db.Order("id").Find(&keys).Error
+	return keys, err
+}
+
+func (repo *SigningKeySqliteRepository) Rotate(key *SigningKey, retiringKid string, retireAt time.Time) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().
+			Where("retire_at < ? AND private_key IS NOT NULL", time.Now()).
+			Delete(&SigningKey{}).
+			Error
+		if err != nil {
+			return err
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "kid"}},
+			DoUpdates: clause.AssignmentColumns([]string{"current", "retire_at", "updated_at"}),
+		}).Create(&SigningKey{Kid: retiringKid, RetireAt: &retireAt}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+}
+
+func (repo *SigningKeySqliteRepository) Reinstate(kid, retiringKid string, retireAt time.Time) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().
+			Where("kid = ? AND private_key IS NULL", kid).
+			Delete(&SigningKey{}).
+			Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&SigningKey{}).
+			Where("kid = ?", retiringKid).
+			Updates(map[string]interface{}{"current": false, "retire_at": retireAt}).
+			Error
+	})
+}
+
+func NewSigningKeySqliteRepository() *SigningKeySqliteRepository {
+	return &SigningKeySqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type TokenRevocationSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *TokenRevocationSqliteRepository) Revoke(jti string, expiresAt time.Time) error {
+	err := repo.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error
+	if err != nil {
+		return err
+	}
+	return repo.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RevokedToken{Jti: jti, ExpiresAt: expiresAt}).
+		Error
+}
+
+func (repo *TokenRevocationSqliteRepository) IsRevoked(jti string) (bool, error) {
+	var count int64
+	err := repo.db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+func (repo *TokenRevocationSqliteRepository) RevokeAllBefore(username string, before time.Time) error {
+	return repo.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "username"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_before", "updated_at"}),
+	}).Create(&TokenRevocation{Username: username, RevokedBefore: before.UnixMilli()}).Error
+}
+
+func (repo *TokenRevocationSqliteRepository) RevokedBefore(username string) (time.Time, error) {
+	var revocations []TokenRevocation
+	err := repo.db.Limit(1).Find(&revocations, "username = ?", username).Error
+	if err != nil || len(revocations) == 0 {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(revocations[0].RevokedBefore), nil
+}
+
+func NewTokenRevocationSqliteRepository() *TokenRevocationSqliteRepository {
+	return &TokenRevocationSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type LoginAttemptSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *LoginAttemptSqliteRepository) Find(key string) (*LoginAttempt, error) {
+	var attempts []*LoginAttempt
+	err := repo.db.Limit(1).Find(&attempts, "key = ?", key).Error
+	if err != nil || len(attempts) == 0 {
+		return &LoginAttempt{Key: key}, err
+	}
+	return attempts[0], nil
+}
+
+func (repo *LoginAttemptSqliteRepository) Increment(key string, windowStart time.Time) (*LoginAttempt, error) {
+	now := time.Now()
+	attempt := &LoginAttempt{}
+	err := repo.db.Raw("INSERT INTO login_attempts (created_at, updated_at, `key`, failures, last_failure, locked_until) "+
+		"VALUES (?, ?, ?, 1, ?, ?) ON CONFLICT (`key`) DO UPDATE SET "+
+		"failures = CASE WHEN login_attempts.updated_at < ? THEN 1 ELSE login_attempts.failures + 1 END, "+
+		"updated_at = excluded.updated_at RETURNING *",
+		now, now, key, time.Time{}, time.Time{}, windowStart).
+		Scan(attempt).Error
+	return attempt, err
+}
+
+func (repo *LoginAttemptSqliteRepository) Decrement(key string) error {
+	return repo.db.Model(&LoginAttempt{}).
+		Where("key = ? AND failures > 0", key).
+		Update("failures", gorm.Expr("failures - 1")).
+		Error
+}
+
+func (repo *LoginAttemptSqliteRepository) RecordFailure(key string, at time.Time) (*LoginAttempt, error) {
+	attempt := &LoginAttempt{Key: key}
+	err := repo.db.Raw("UPDATE login_attempts SET last_failure = ?, updated_at = ? WHERE `key` = ? RETURNING *",
+		at, at, key).
+		Scan(attempt).Error
+	return attempt, err
+}
+
+func (repo *LoginAttemptSqliteRepository) Lock(key string, until time.Time) error {
+	return repo.db.Model(&LoginAttempt{}).
+		Where("key = ?", key).
+		Updates(map[string]interface{}{"failures": 0, "locked_until": until}).
+		Error
+}
+
+func (repo *LoginAttemptSqliteRepository) Delete(key string) error {
+	return repo.db.Unscoped().Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
+
+func NewLoginAttemptSqliteRepository() *LoginAttemptSqliteRepository {
+	return &LoginAttemptSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type PasswordResetTokenSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *PasswordResetTokenSqliteRepository) Save(token *PasswordResetToken) error {
+	return repo.db.Create(token).Error
+}
+
+func (repo *PasswordResetTokenSqliteRepository) FindByHash(hash string) (*PasswordResetToken, error) {
+	token := new(PasswordResetToken)
+	err := repo.db.First(token, "token_hash = ?", hash).Error
+	return token, err
+}
+
+func (repo *PasswordResetTokenSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&PasswordResetToken{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (repo *PasswordResetTokenSqliteRepository) DeleteAllByOwnerUsername(ownerUsername string) error {
+	return repo.db.Unscoped().
+		Where("owner_refer = ?", ownerUsername).
+		Delete(&PasswordResetToken{}).
+		Error
+}
+
+func NewPasswordResetTokenSqliteRepository() *PasswordResetTokenSqliteRepository {
+	return &PasswordResetTokenSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type EmailVerificationTokenSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *EmailVerificationTokenSqliteRepository) Save(token *EmailVerificationToken) error {
+	return repo.db.Create(token).Error
+}
+
+func (repo *EmailVerificationTokenSqliteRepository) FindByHash(hash string) (*EmailVerificationToken, error) {
+	token := new(EmailVerificationToken)
+	err := repo.db.First(token, "token_hash = ?", hash).Error
+	return token, err
+}
+
+func (repo *EmailVerificationTokenSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&EmailVerificationToken{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (repo *EmailVerificationTokenSqliteRepository) CountCreatedSince(ownerUsername string, since time.Time) (int64, error) {
+	var count int64
+	err := repo.db.Model(&EmailVerificationToken{}).
+		Where("owner_refer = ? AND created_at > ?", ownerUsername, since).
+		Count(&count).
+		Error
+	return count, err
+}
+
+func NewEmailVerificationTokenSqliteRepository() *EmailVerificationTokenSqliteRepository {
+	return &EmailVerificationTokenSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type TotpCredentialSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *TotpCredentialSqliteRepository) Save(credential *TotpCredential) error {
+	return repo.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "owner_refer"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "confirmed", "last_step", "updated_at"}),
+	}).Create(credential).Error
+}
+
+func (repo *TotpCredentialSqliteRepository) FindByOwnerUsername(ownerUsername string) (*TotpCredential, error) {
+	var credentials []*TotpCredential
+	err := repo.db.Limit(1).Find(&credentials, "owner_refer = ?", ownerUsername).Error
+	if err != nil || len(credentials) == 0 {
+		return &TotpCredential{OwnerRefer: ownerUsername}, err
+	}
+	return credentials[0], nil
+}
+
+func (repo *TotpCredentialSqliteRepository) Confirm(ownerUsername string) error {
+	return repo.db.Model(&TotpCredential{}).
+		Where("owner_refer = ?", ownerUsername).
+		Update("confirmed", true).
+		Error
+}
+
+func (repo *TotpCredentialSqliteRepository) UpdateLastStep(ownerUsername string, step int64) (bool, error) {
+	result := repo.db.Model(&TotpCredential{}).
+		Where("owner_refer = ? AND last_step < ?", ownerUsername, step).
+		Update("last_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (repo *TotpCredentialSqliteRepository) DeleteByOwnerUsername(ownerUsername string) error {
+	return repo.db.Unscoped().
+		Where("owner_refer = ?", ownerUsername).
+		Delete(&TotpCredential{}).
+		Error
+}
+
+func NewTotpCredentialSqliteRepository() *TotpCredentialSqliteRepository {
+	return &TotpCredentialSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type RecoveryCodeSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *RecoveryCodeSqliteRepository) ReplaceAll(ownerUsername string, codes []RecoveryCode) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("owner_refer = ?", ownerUsername).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (repo *RecoveryCodeSqliteRepository) MarkUsed(ownerUsername, hash string) (bool, error) {
+	result := repo.db.Model(&RecoveryCode{}).
+		Where("owner_refer = ? AND code_hash = ? AND used = ?", ownerUsername, hash, false).
+		Update("used", true)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (repo *RecoveryCodeSqliteRepository) DeleteAllByOwnerUsername(ownerUsername string) error {
+	return repo.db.Unscoped().
+		Where("owner_refer = ?", ownerUsername).
+		Delete(&RecoveryCode{}).
+		Error
+}
+
+func NewRecoveryCodeSqliteRepository() *RecoveryCodeSqliteRepository {
+	return &RecoveryCodeSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type MfaChallengeSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *MfaChallengeSqliteRepository) Save(challenge *MfaChallenge) error {
+	return repo.db.Create(challenge).Error
+}
+
+func (repo *MfaChallengeSqliteRepository) FindByHash(hash string) (*MfaChallenge, error) {
+	challenge := new(MfaChallenge)
+	err := repo.db.First(challenge, "token_hash = ?", hash).Error
+	return challenge, err
+}
+
+func (repo *MfaChallengeSqliteRepository) IncrementAttempts(id uint) error {
+	return repo.db.Model(&MfaChallenge{}).
+		Where("id = ?", id).
+		Update("attempts", gorm.Expr("attempts + 1")).
+		Error
+}
+
+func (repo *MfaChallengeSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&MfaChallenge{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewMfaChallengeSqliteRepository() *MfaChallengeSqliteRepository {
+	return &MfaChallengeSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type WebAuthnCredentialSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *WebAuthnCredentialSqliteRepository) Save(credential *WebAuthnCredential) error {
+	return repo.db.Create(credential).Error
+}
+
+func (repo *WebAuthnCredentialSqliteRepository) FindAllByOwnerUsername(ownerUsername string) ([]*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	err := repo.db.Find(&credentials, "owner_refer = ?", ownerUsername).Error
+	return credentials, err
+}
+
+func (repo *WebAuthnCredentialSqliteRepository) FindByCredentialId(credentialId []byte) (*WebAuthnCredential, error) {
+	credential := new(WebAuthnCredential)
+	err := repo.db.First(credential, "credential_id = ?", credentialId).Error
+	return credential, err
+}
+
+func (repo *WebAuthnCredentialSqliteRepository) UpdateUsage(credential *WebAuthnCredential) error {
+	return repo.db.Model(&WebAuthnCredential{}).
+		Where("id = ?", credential.ID).
+		Updates(map[string]interface{}{
+			"sign_count":    credential.SignCount,
+			"clone_warning": credential.CloneWarning,
+			"backup_state":  credential.BackupState,
+			"last_used_at":  credential.LastUsedAt,
+		}).
+		Error
+}
+
+func (repo *WebAuthnCredentialSqliteRepository) Delete(ownerUsername string, id uint) (bool, error) {
+	result := repo.db.Unscoped().
+		Where("id = ? AND owner_refer = ?", id, ownerUsername).
+		Delete(&WebAuthnCredential{})
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewWebAuthnCredentialSqliteRepository() *WebAuthnCredentialSqliteRepository {
+	return &WebAuthnCredentialSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type WebAuthnSessionSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *WebAuthnSessionSqliteRepository) Save(session *WebAuthnSession) error {
+	err := repo.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&WebAuthnSession{}).Error
+	if err != nil {
+		return err
+	}
+	return repo.db.Create(session).Error
+}
+
+func (repo *WebAuthnSessionSqliteRepository) FindByHash(hash string) (*WebAuthnSession, error) {
+	session := new(WebAuthnSession)
+	err := repo.db.First(session, "token_hash = ?", hash).Error
+	return session, err
+}
+
+func (repo *WebAuthnSessionSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&WebAuthnSession{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewWebAuthnSessionSqliteRepository() *WebAuthnSessionSqliteRepository {
+	return &WebAuthnSessionSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type ApiKeySqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *ApiKeySqliteRepository) Save(key *ApiKey) error {
+	return repo.db.Create(key).Error
+}
+
+func (repo *ApiKeySqliteRepository) FindByPrefix(prefix string) (*ApiKey, error) {
+	key := new(ApiKey)
+	err := repo.db.First(key, "prefix = ?", prefix).Error
+	return key, err
+}
+
+func (repo *ApiKeySqliteRepository) FindAllByOwnerUsername(ownerUsername string) ([]*ApiKey, error) {
+	var keys []*ApiKey
+	err := repo.db.Find(&keys, "owner_refer = ?", ownerUsername).Error
+	return keys, err
+}
+
+func (repo *ApiKeySqliteRepository) UpdateLastUsed(id uint, lastUsedAt time.Time) error {
+	return repo.db.Model(&ApiKey{}).
+		Where("id = ?", id).
+		Update("last_used_at", lastUsedAt).
+		Error
+}
+
+func (repo *ApiKeySqliteRepository) Revoke(ownerUsername string, id uint) (bool, error) {
+	result := repo.db.Model(&ApiKey{}).
+		Where("id = ? AND owner_refer = ? AND revoked = ?", id, ownerUsername, false).
+		Update("revoked", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (repo *ApiKeySqliteRepository) RevokeAllByOwnerUsername(ownerUsername string) error {
+	return repo.db.Model(&ApiKey{}).
+		Where("owner_refer = ? AND revoked = ?", ownerUsername, false).
+		Update("revoked", true).
+		Error
+}
+
+func NewApiKeySqliteRepository() *ApiKeySqliteRepository {
+	return &ApiKeySqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type OAuthClientSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *OAuthClientSqliteRepository) Save(client *OAuthClient) error {
+	return repo.db.Create(client).Error
+}
+
+func (repo *OAuthClientSqliteRepository) FindByClientId(clientId string) (*OAuthClient, error) {
+	client := new(OAuthClient)
+	err := repo.db.First(client, "client_id = ?", clientId).Error
+	return client, err
+}
+
+func (repo *OAuthClientSqliteRepository) FindAll() ([]*OAuthClient, error) {
+	var clients []*OAuthClient
+	err := repo.db.Find(&clients).Error
+	return clients, err
+}
+
+func (repo *OAuthClientSqliteRepository) Delete(clientId string) (bool, error) {
+	result := repo.db.Unscoped().Where("client_id = ?", clientId).Delete(&OAuthClient{})
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewOAuthClientSqliteRepository() *OAuthClientSqliteRepository {
+	return &OAuthClientSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type AuthorizationCodeSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *AuthorizationCodeSqliteRepository) Save(code *AuthorizationCode) error {
+	err := repo.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&AuthorizationCode{}).Error
+	if err != nil {
+		return err
+	}
+	return repo.db.Create(code).Error
+}
+
+func (repo *AuthorizationCodeSqliteRepository) FindByHash(hash string) (*AuthorizationCode, error) {
+	code := new(AuthorizationCode)
+	err := repo.db.First(code, "code_hash = ?", hash).Error
+	return code, err
+}
+
+func (repo *AuthorizationCodeSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&AuthorizationCode{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewAuthorizationCodeSqliteRepository() *AuthorizationCodeSqliteRepository {
+	return &AuthorizationCodeSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type FederatedIdentitySqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *FederatedIdentitySqliteRepository) Save(identity *FederatedIdentity) error {
+	return repo.db.Create(identity).Error
+}
+
+func (repo *FederatedIdentitySqliteRepository) Find(provider, subject string) (*FederatedIdentity, error) {
+	identity := new(FederatedIdentity)
+	err := repo.db.Limit(1).Find(identity, "provider = ? AND subject = ?", provider, subject).Error
+	return identity, err
+}
+
+func (repo *FederatedIdentitySqliteRepository) FindAllByOwnerUsername(ownerUsername string) ([]*FederatedIdentity, error) {
+	var identities []*FederatedIdentity
+	err := repo.db.Find(&identities, "owner_refer = ?", ownerUsername).Error
+	return identities, err
+}
+
+func (repo *FederatedIdentitySqliteRepository) Delete(ownerUsername string, id uint) (bool, error) {
+	result := repo.db.Unscoped().
+		Where("id = ? AND owner_refer = ?", id, ownerUsername).
+		Delete(&FederatedIdentity{})
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewFederatedIdentitySqliteRepository() *FederatedIdentitySqliteRepository {
+	return &FederatedIdentitySqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
+
+type FederatedLoginSessionSqliteRepository struct {
+	db *gorm.DB
+}
+
+func (repo *FederatedLoginSessionSqliteRepository) Save(session *FederatedLoginSession) error {
+	err := repo.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&FederatedLoginSession{}).Error
+	if err != nil {
+		return err
+	}
+	return repo.db.Create(session).Error
+}
+
+func (repo *FederatedLoginSessionSqliteRepository) FindByHash(hash string) (*FederatedLoginSession, error) {
+	session := new(FederatedLoginSession)
+	err := repo.db.First(session, "state_hash = ?", hash).Error
+	return session, err
+}
+
+func (repo *FederatedLoginSessionSqliteRepository) MarkUsed(id uint) (bool, error) {
+	result := repo.db.Model(&FederatedLoginSession{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+	return result.RowsAffected == 1, result.Error
+}
+
+func NewFederatedLoginSessionSqliteRepository() *FederatedLoginSessionSqliteRepository {
+	return &FederatedLoginSessionSqliteRepository{
+		db: InitDatabase(nil),
+	}
+}
@@ -2,138 +2,474 @@ package main
 
 import (
 	"gin-auth/auth"
+	"gin-auth/auth/oauth"
 	"gin-auth/handle"
+	"gin-auth/util"
 	"github.com/gin-gonic/gin"
 )
 
 const serverPortEnv = "GIN_PORT"
 const jwtSecretEnv = "GIN_JWT_SECRET"
+const jwtSigningKeyFileEnv = "GIN_JWT_SIGNING_KEY_FILE"
+const jwtVerificationKeyFilesEnv = "GIN_JWT_VERIFICATION_KEY_FILES"
+const jwtKeyRotationIntervalEnv = "GIN_JWT_KEY_ROTATION_INTERVAL"
+const jwtKeyEncryptionKeyEnv = "GIN_JWT_KEY_ENCRYPTION_KEY"
+const jwtTTLEnv = "GIN_JWT_TTL"
+const jwtLeewayEnv = "GIN_JWT_LEEWAY"
+const jwtAudienceEnv = "GIN_JWT_AUDIENCE"
+const jwtAcceptedAudiencesEnv = "GIN_JWT_ACCEPTED_AUDIENCES"
+const jwtIssuerEnv = "GIN_JWT_ISSUER"
+const passwordEncoderEnv = "GIN_PASSWORD_ENCODER"
+const passwordPeppersEnv = "GIN_PASSWORD_PEPPERS"
+const passwordPepperFileEnv = "GIN_PASSWORD_PEPPER_FILE"
+const passwordPepperVersionEnv = "GIN_PASSWORD_PEPPER_VERSION"
+const passwordMinLengthEnv = "GIN_PASSWORD_MIN_LENGTH"
+const passwordMaxBytesEnv = "GIN_PASSWORD_MAX_BYTES"
+const passwordMinCharClassesEnv = "GIN_PASSWORD_MIN_CHAR_CLASSES"
+const passwordMinUsernameLengthEnv = "GIN_PASSWORD_MIN_USERNAME_LENGTH"
+const passwordCommonListFileEnv = "GIN_PASSWORD_COMMON_LIST_FILE"
+const passwordResetTTLEnv = "GIN_PASSWORD_RESET_TTL"
+const passwordResetUrlEnv = "GIN_PASSWORD_RESET_URL"
+const passwordResetWorkersEnv = "GIN_PASSWORD_RESET_WORKERS"
+const passwordResetQueueSizeEnv = "GIN_PASSWORD_RESET_QUEUE_SIZE"
+const unverifiedEmailPolicyEnv = "GIN_UNVERIFIED_EMAIL_POLICY"
+const emailVerificationTTLEnv = "GIN_EMAIL_VERIFICATION_TTL"
+const emailVerificationUrlEnv = "GIN_EMAIL_VERIFICATION_URL"
+const emailVerificationCooldownEnv = "GIN_EMAIL_VERIFICATION_COOLDOWN"
+const emailVerificationWorkersEnv = "GIN_EMAIL_VERIFICATION_WORKERS"
+const emailVerificationQueueSizeEnv = "GIN_EMAIL_VERIFICATION_QUEUE_SIZE"
+const mfaIssuerEnv = "GIN_MFA_ISSUER"
+const mfaRequiredRolesEnv = "GIN_MFA_REQUIRED_ROLES"
+const webAuthnRPIDEnv = "GIN_WEBAUTHN_RP_ID"
+const webAuthnRPDisplayNameEnv = "GIN_WEBAUTHN_RP_DISPLAY_NAME"
+const webAuthnRPOriginsEnv = "GIN_WEBAUTHN_RP_ORIGINS"
+const apiKeyDefaultTTLEnv = "GIN_API_KEY_DEFAULT_TTL"
+const apiKeyMaxTTLEnv = "GIN_API_KEY_MAX_TTL"
+const oauthCodeTTLEnv = "GIN_OAUTH_CODE_TTL"
+const oauthScopeRolesEnv = "GIN_OAUTH_SCOPE_ROLES"
+const oauthIdTokenHintMaxAgeEnv = "GIN_OAUTH_ID_TOKEN_HINT_MAX_AGE"
+const federatedProvidersEnv = "GIN_FEDERATED_PROVIDERS"
+const federatedSessionTTLEnv = "GIN_FEDERATED_SESSION_TTL"
+const ldapUrlEnv = "GIN_LDAP_URL"
+const ldapStartTLSEnv = "GIN_LDAP_START_TLS"
+const ldapCACertFileEnv = "GIN_LDAP_CA_CERT_FILE"
+const ldapInsecureSkipVerifyEnv = "GIN_LDAP_INSECURE_SKIP_VERIFY"
+const ldapBindDNEnv = "GIN_LDAP_BIND_DN"
+const ldapBindPasswordEnv = "GIN_LDAP_BIND_PASSWORD"
+const ldapUserDNTemplateEnv = "GIN_LDAP_USER_DN_TEMPLATE"
+const ldapBaseDNEnv = "GIN_LDAP_BASE_DN"
+const ldapUserFilterEnv = "GIN_LDAP_USER_FILTER"
+const ldapUsernameAttributeEnv = "GIN_LDAP_USERNAME_ATTRIBUTE"
+const ldapEmailAttributeEnv = "GIN_LDAP_EMAIL_ATTRIBUTE"
+const ldapGroupsAttributeEnv = "GIN_LDAP_GROUPS_ATTRIBUTE"
+const ldapGroupBaseDNEnv = "GIN_LDAP_GROUP_BASE_DN"
+const ldapGroupFilterEnv = "GIN_LDAP_GROUP_FILTER"
+const ldapGroupRolesEnv = "GIN_LDAP_GROUP_ROLES"
+const ldapTimeoutEnv = "GIN_LDAP_TIMEOUT"
+const sessionModeEnv = "GIN_SESSION_MODE"
+const sessionCookieSecureEnv = "GIN_SESSION_COOKIE_SECURE"
+const sessionCookieSameSiteEnv = "GIN_SESSION_COOKIE_SAME_SITE"
+const tokenExtractorsEnv = "GIN_TOKEN_EXTRACTORS"
+const accountTokenExtractorsEnv = "GIN_ACCOUNT_TOKEN_EXTRACTORS"
+const tokenHeaderEnv = "GIN_TOKEN_HEADER"
+const tokenHeaderPrefixEnv = "GIN_TOKEN_HEADER_PREFIX"
+const tokenQueryParamEnv = "GIN_TOKEN_QUERY_PARAM"
+const mailerEnv = "GIN_MAILER"
+const mailFromEnv = "GIN_MAIL_FROM"
+const mailFileEnv = "GIN_MAIL_FILE"
+const smtpHostEnv = "GIN_SMTP_HOST"
+const smtpPortEnv = "GIN_SMTP_PORT"
+const smtpUsernameEnv = "GIN_SMTP_USERNAME"
+const smtpPasswordEnv = "GIN_SMTP_PASSWORD"
+const trustedProxiesEnv = "GIN_TRUSTED_PROXIES"
+const loginMaxUserFailuresEnv = "GIN_LOGIN_MAX_USER_FAILURES"
+const loginMaxIpFailuresEnv = "GIN_LOGIN_MAX_IP_FAILURES"
+const loginLockoutDurationEnv = "GIN_LOGIN_LOCKOUT_DURATION"
+const loginBaseDelayEnv = "GIN_LOGIN_BASE_DELAY"
+const loginMaxDelayEnv = "GIN_LOGIN_MAX_DELAY"
+const loginFailureWindowEnv = "GIN_LOGIN_FAILURE_WINDOW"
+const introspectionClientIdEnv = "GIN_INTROSPECTION_CLIENT_ID"
+const introspectionClientSecretEnv = "GIN_INTROSPECTION_CLIENT_SECRET"
+const tokenRevocationStoreEnv = "GIN_TOKEN_REVOCATION_STORE"
 
 const serverDefaultPort = 9000
 const jwtSecretDefault = "s3cr3t"
+const tokenRevocationStoreDefault = "sqlite"
+
+const tokenRevocationStoreMemory = "memory"
+const introspectionClientIdDefault = "introspection"
+const mailFromDefault = "gin-auth@localhost"
+const mailFileDefault = "mail.log"
+const smtpHostDefault = "localhost"
+const smtpPortDefault = 25
+
+const federatedProviderEnvPrefix = "GIN_FEDERATED_"
+const federatedIssuerEnvSuffix = "_ISSUER"
+const federatedClientIdEnvSuffix = "_CLIENT_ID"
+const federatedClientSecretEnvSuffix = "_CLIENT_SECRET"
+const federatedRedirectUrlEnvSuffix = "_REDIRECT_URL"
+const federatedScopesEnvSuffix = "_SCOPES"
+const federatedUsernameClaimEnvSuffix = "_USERNAME_CLAIM"
+const federatedGroupsClaimEnvSuffix = "_GROUPS_CLAIM"
+const federatedGroupRolesEnvSuffix = "_GROUP_ROLES"
+const federatedAutoProvisionEnvSuffix = "_AUTO_PROVISION"
+const federatedLinkVerifiedEmailEnvSuffix = "_LINK_VERIFIED_EMAIL"
+
+const mailerLog = "log"
+const mailerFile = "file"
+const mailerSmtp = "smtp"
+
+const sessionModeBearer = "bearer"
+const sessionModeCookie = "cookie"
+
+const tokenExtractorBearer = "bearer"
+const tokenExtractorHeader = "header"
+const tokenExtractorCookie = "cookie"
+const tokenExtractorQuery = "query"
+const tokenHeaderDefault = "X-Access-Token"
+const tokenQueryParamDefault = "access_token"
 
 const jwtIssuer = "gin-auth"
 
 func routeHandlerFuncs(e *gin.Engine) {
 
-	e.Use(handle.JwtAuthenticationMw(jwtService))
+	clients := e.Group("")
+
+	clients.POST("/introspect",
+		handle.ClientCredentialsMw(
+			util.GetEnvVar(introspectionClientIdEnv, introspectionClientIdDefault),
+			util.GetEnvVar(introspectionClientSecretEnv, ""),
+		),
+		handle.Introspect(jwtService, userRepo),
+	)
+
+	clients.POST("/oauth/token",
+		handle.IssueOAuthToken(oauthService),
+	)
+
+	public := e.Group("",
+		handle.ApiKeyAuthenticationMw(apiKeyService),
+		handle.JwtAuthenticationMw(jwtService),
+	)
 
-	e.GET("/health",
+	public.GET("/health",
 		handle.Health,
 	)
 
-	e.POST("/login",
-		handle.Login(loginService, jwtService),
+	public.GET("/.well-known/jwks.json",
+		handle.Jwks(jwtService),
+	)
+
+	public.GET("/.well-known/openid-configuration",
+		handle.OpenIdConfiguration(oauthService),
+	)
+
+	public.POST("/login",
+		handle.Login(loginService, tokenService, mfaService, loginGuard, sessionCookieConfig),
+	)
+
+	public.POST("/login/mfa",
+		handle.LoginMfa(mfaService, tokenService, loginGuard, sessionCookieConfig),
+	)
+
+	public.POST("/webauthn/login/begin",
+		handle.BeginWebAuthnLogin(webAuthnService),
+	)
+
+	public.POST("/webauthn/login/finish",
+		handle.FinishWebAuthnLogin(webAuthnService, tokenService, sessionCookieConfig),
+	)
+
+	public.GET("/federated/providers",
+		handle.FindAllFederatedProviders(federatedService),
+	)
+
+	public.GET("/federated/:provider/login",
+		handle.BeginFederatedLogin(federatedService, sessionCookieConfig),
+	)
+
+	public.GET("/federated/:provider/callback",
+		handle.FinishFederatedLogin(federatedService, tokenService, mfaService, sessionCookieConfig),
+	)
+
+	public.POST("/token/refresh",
+		handle.RefreshToken(tokenService, sessionCookieConfig),
+	)
+
+	public.GET("/oauth/authorize",
+		handle.AuthorizeConsent(oauthService),
+	)
+
+	public.POST("/oauth/authorize",
+		handle.Authorize(oauthService, loginService, mfaService, loginGuard),
+	)
+
+	public.GET("/oauth/logout",
+		handle.EndSession(oauthService, sessionCookieConfig),
+	)
+
+	public.POST("/oauth/logout",
+		handle.EndSession(oauthService, sessionCookieConfig),
+	)
+
+	public.POST("/password/forgot",
+		handle.ForgotPassword(passwordResetService, passwordResetConfig),
+	)
+
+	public.POST("/password/reset",
+		handle.ResetPassword(passwordResetService, tokenService, apiKeyService, loginGuard),
+	)
+
+	public.POST("/email/verify",
+		handle.VerifyEmail(emailVerificationService),
+	)
+
+	public.POST("/email/verify/resend",
+		handle.ResendVerification(emailVerificationService, emailVerificationConfig),
+	)
+
+	public.POST("/user",
+		handle.SaveUser(userRepo, passEncoder, passPolicy, emailVerificationService, emailVerificationConfig),
+	)
+
+	account := e.Group("",
+		handle.ApiKeyAuthenticationMw(apiKeyService),
+		handle.JwtAuthenticationRequiredMw(jwtService, accountTokenExtractors...),
+		handle.FirstPartyRequiredMw(),
+	)
+
+	account.POST("/key/rotate",
+		handle.ApiKeyForbiddenMw(),
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.RotateKeys(jwtService),
+	)
+
+	account.POST("/webauthn/register/begin",
+		handle.ApiKeyForbiddenMw(),
+		handle.BeginWebAuthnRegistration(userRepo, webAuthnService),
+	)
+
+	account.POST("/webauthn/register/finish",
+		handle.ApiKeyForbiddenMw(),
+		handle.FinishWebAuthnRegistration(userRepo, webAuthnService),
+	)
+
+	account.GET("/webauthn/credentials",
+		handle.FindAllWebAuthnCredentials(webAuthnService),
+	)
+
+	account.DELETE("/webauthn/credentials/:id",
+		handle.ApiKeyForbiddenMw(),
+		handle.DeleteWebAuthnCredential(webAuthnService),
+	)
+
+	account.POST("/mfa/totp/enroll",
+		handle.ApiKeyForbiddenMw(),
+		handle.EnrollTotp(mfaService, loginService, loginGuard),
+	)
+
+	account.POST("/mfa/totp/confirm",
+		handle.ApiKeyForbiddenMw(),
+		handle.ConfirmTotp(mfaService, tokenService),
+	)
+
+	account.POST("/mfa/totp/disable",
+		handle.ApiKeyForbiddenMw(),
+		handle.DisableTotp(mfaService, loginGuard),
+	)
+
+	account.POST("/mfa/recovery-codes",
+		handle.ApiKeyForbiddenMw(),
+		handle.RegenerateRecoveryCodes(mfaService, loginGuard),
+	)
+
+	account.DELETE("/lockout/user/:username",
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.UnlockUser(loginGuard),
+	)
+
+	account.DELETE("/lockout/ip/:ip",
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.UnlockIp(loginGuard),
+	)
+
+	account.POST("/federated/:provider/link",
+		handle.ApiKeyForbiddenMw(),
+		handle.BeginFederatedLink(federatedService, sessionCookieConfig),
+	)
+
+	account.GET("/federated/identities",
+		handle.FindAllFederatedIdentities(federatedService),
+	)
+
+	account.DELETE("/federated/identities/:id",
+		handle.ApiKeyForbiddenMw(),
+		handle.UnlinkFederatedIdentity(federatedService),
+	)
+
+	account.POST("/logout/all",
+		handle.ApiKeyForbiddenMw(),
+		handle.LogoutEverywhere(tokenService, apiKeyService, sessionCookieConfig),
+	)
+
+	account.PUT("/user",
+		handle.ApiKeyForbiddenMw(),
+		handle.UpdateUser(userRepo, loginService, federatedService, passEncoder, passPolicy, tokenService,
+			apiKeyService, loginGuard, sessionCookieConfig),
+	)
+
+	account.POST("/api-key",
+		handle.ApiKeyForbiddenMw(),
+		handle.CreateApiKey(userRepo, apiKeyService),
+	)
+
+	account.GET("/api-key/list",
+		handle.ApiKeyForbiddenMw(),
+		handle.FindAllApiKeys(apiKeyService),
+	)
+
+	account.DELETE("/api-key/:id",
+		handle.ApiKeyForbiddenMw(),
+		handle.RevokeApiKey(apiKeyService),
+	)
+
+	account.POST("/oauth/client",
+		handle.ApiKeyForbiddenMw(),
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.RegisterOAuthClient(oauthService),
+	)
+
+	account.GET("/oauth/client/list",
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.FindAllOAuthClients(oauthService),
+	)
+
+	account.DELETE("/oauth/client/:clientId",
+		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
+		handle.DeleteOAuthClient(oauthService),
+	)
+
+	oidc := e.Group("",
+		handle.JwtAuthenticationRequiredMw(jwtService, handle.BearerTokenExtractor()),
+	)
+
+	oidc.GET("/userinfo",
+		handle.UserInfo(oauthService),
+	)
+
+	oidc.POST("/userinfo",
+		handle.UserInfo(oauthService),
 	)
 
-	e.POST("/user",
-		handle.SaveUser(userRepo, passEncoder),
+	resources := e.Group("",
+		handle.ApiKeyAuthenticationMw(apiKeyService),
+		handle.JwtAuthenticationRequiredMw(jwtService, resourceTokenExtractors...),
 	)
 
-	e.PUT("/user",
-		handle.JwtAuthenticationRequiredMw(jwtService),
-		handle.UpdateUser(userRepo, passEncoder),
+	resources.POST("/logout",
+		handle.ApiKeyForbiddenMw(),
+		handle.Logout(jwtService, tokenService, sessionCookieConfig),
 	)
 
-	e.GET("/user",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/user",
+		handle.ScopeRequiredMw(oauth.ScopeProfile),
 		handle.FindUser(userRepo),
 	)
 
-	e.GET("/user/:username",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/user/:username",
+		handle.ScopeRequiredMw(oauth.ScopeProfile),
 		handle.FindUserByUsername(userRepo),
 	)
 
-	e.POST("/post",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.POST("/post",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.SavePost(postRepo),
 	)
 
-	e.PUT("/post/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.PUT("/post/:id",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.UpdatePost(postRepo),
 	)
 
-	e.PUT("/post/force/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.PUT("/post/force/:id",
+		handle.ScopeRequiredMw(auth.ScopeManage, auth.ScopeAdmin),
 		handle.JwtAuthorizationHasAnyRoleMv(auth.RoleAdmin, auth.RoleManager),
 		handle.UpdatePostForcibly(postRepo),
 	)
 
-	e.GET("/post/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/post/:id",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.FindPost(postRepo),
 	)
 
-	e.GET("/post/list",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/post/list",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.FindAllPosts(postRepo),
 	)
 
-	e.GET("/post/list/:username",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/post/list/:username",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.FindAllPostsByUsername(postRepo),
 	)
 
-	e.DELETE("/post/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.DELETE("/post/:id",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.DeletePost(postRepo),
 	)
 
-	e.DELETE("/post/force/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.DELETE("/post/force/:id",
+		handle.ScopeRequiredMw(auth.ScopeManage, auth.ScopeAdmin),
 		handle.JwtAuthorizationHasAnyRoleMv(auth.RoleAdmin, auth.RoleManager),
 		handle.DeletePostForcibly(postRepo),
 	)
 
-	e.POST("/comment/:postId",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.POST("/comment/:postId",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.SaveComment(commentRepo),
 	)
 
-	e.PUT("/comment/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.PUT("/comment/:id",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.UpdateComment(commentRepo),
 	)
 
-	e.PUT("/comment/force/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.PUT("/comment/force/:id",
+		handle.ScopeRequiredMw(auth.ScopeModerate, auth.ScopeManage, auth.ScopeAdmin),
 		handle.JwtAuthorizationHasAnyRoleMv(auth.RoleAdmin, auth.RoleManager, auth.RoleModerator),
 		handle.UpdateCommentForcibly(commentRepo),
 	)
 
-	e.GET("/comment/list",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/comment/list",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.FindAllComments(commentRepo),
 	)
 
-	e.GET("/comment/list/:username",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.GET("/comment/list/:username",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.FindAllCommentsByUsername(commentRepo),
 	)
 
-	e.DELETE("/comment/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.DELETE("/comment/:id",
+		handle.ScopeRequiredMw(auth.ScopePosts),
 		handle.DeleteComment(commentRepo),
 	)
 
-	e.DELETE("/comment/force/:id",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.DELETE("/comment/force/:id",
+		handle.ScopeRequiredMw(auth.ScopeModerate, auth.ScopeManage, auth.ScopeAdmin),
 		handle.JwtAuthorizationHasAnyRoleMv(auth.RoleAdmin, auth.RoleManager, auth.RoleModerator),
 		handle.DeleteCommentForcibly(commentRepo),
 	)
 
-	e.PUT("/role/:username",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.PUT("/role/:username",
+		handle.ScopeRequiredMw(auth.ScopeAdmin),
 		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
 		handle.AddRole(userRepo),
 	)
 
-	e.DELETE("/role/:username",
-		handle.JwtAuthenticationRequiredMw(jwtService),
+	resources.DELETE("/role/:username",
+		handle.ScopeRequiredMw(auth.ScopeAdmin),
 		handle.JwtAuthorizationHasEachRoleMv(auth.RoleAdmin),
-		handle.RemoveRole(userRepo),
+		handle.RemoveRole(userRepo, tokenService),
 	)
 
 }
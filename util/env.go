@@ -3,6 +3,8 @@ package util
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func GetEnvVar(key, def string) string {
@@ -23,3 +25,36 @@ func GetIntEnvVar(key string, def int) int {
 	}
 	return def
 }
+
+func GetBoolEnvVar(key string, def bool) bool {
+	envVarStr := os.Getenv(key)
+	if envVarStr != "" {
+		envVar, err := strconv.ParseBool(envVarStr)
+		if err == nil {
+			return envVar
+		}
+	}
+	return def
+}
+
+func GetListEnvVar(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func GetDurationEnvVar(key string, def time.Duration) time.Duration {
+	envVarStr := os.Getenv(key)
+	if envVarStr != "" {
+		envVar, err := time.ParseDuration(envVarStr)
+		if err == nil {
+			return envVar
+		}
+	}
+	return def
+}